@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/zhihu/promate/prometheus"
+)
+
+// BackendConfig is a VictoriaMetrics cluster or tenant serving some graphite roots.
+// The targets not routed to any backend are served by prometheus_url.
+type BackendConfig struct {
+	// The name of the backend in the logs.
+	Name string `yaml:"name"`
+	// The prometheus api url, such as http://vmselect:8481/select/0/prometheus.
+	// When tenant_id is set it's the vmselect address, and /select/<tenant_id>/prometheus is appended.
+	URL string `yaml:"url"`
+	// The equivalent replicas of url, tenant_id is applied to them too.
+	Replicas []string `yaml:"replicas"`
+	// The VictoriaMetrics cluster tenant, such as 42 or 42:1.
+	TenantID string `yaml:"tenant_id"`
+	// The first segments of the paths stored in the backend.
+	Roots []string `yaml:"roots"`
+	// The graphite globs matching the full paths stored in the backend, they are matched before the roots.
+	Patterns []string `yaml:"patterns"`
+
+	url         string
+	replicaURLs []string
+	patternRes  []*regexp.Regexp
+}
+
+func (b *BackendConfig) apiURL(url string) string {
+	url = strings.TrimSuffix(url, "/")
+	if b.TenantID != "" {
+		url = fmt.Sprintf("%s/select/%s/prometheus", url, b.TenantID)
+	}
+	return url
+}
+
+// backendRoute is a target rewritten for a backend.
+type backendRoute struct {
+	url    string
+	target string
+}
+
+func compileBackends(backends []*BackendConfig) error {
+	for i, backend := range backends {
+		if backend.URL == "" {
+			return fmt.Errorf("backend %d: url is required", i)
+		}
+		backend.url = backend.apiURL(backend.URL)
+		backend.replicaURLs = make([]string, 0, len(backend.Replicas))
+		for _, replica := range backend.Replicas {
+			backend.replicaURLs = append(backend.replicaURLs, backend.apiURL(replica))
+		}
+
+		backend.patternRes = make([]*regexp.Regexp, 0, len(backend.Patterns))
+		for _, pattern := range backend.Patterns {
+			re, err := compilePathRegexp(pattern, "")
+			if err != nil {
+				return fmt.Errorf("backend %d: %w", i, err)
+			}
+			backend.patternRes = append(backend.patternRes, re)
+		}
+		for _, root := range backend.Roots {
+			if !isLiteralRoot(root) {
+				return fmt.Errorf("backend %d: root %q must be a single literal segment", i, root)
+			}
+		}
+	}
+	return nil
+}
+
+func isLiteralRoot(root string) bool {
+	return root != "" && !strings.ContainsAny(root, ".*?[]{}")
+}
+
+// routesOf returns the backends serving target.
+// A target whose first segment is a glob is expanded to the matching roots of all backends and prometheus_roots, so it may span several backends.
+// It's sent to prometheus_url as is when no root matches, as the first segment can't be a glob in the queries.
+func (c *Config) routesOf(target string) []backendRoute {
+	for _, backend := range c.Backends {
+		for _, re := range backend.patternRes {
+			if re.MatchString(target) {
+				return []backendRoute{{url: backend.url, target: target}}
+			}
+		}
+	}
+
+	if prometheus.IsSeriesByTag(target) {
+		// The name tag is required, so the series of a seriesByTag are always under one root.
+		name, _, err := prometheus.ConvertSeriesByTag(target)
+		if err != nil {
+			return []backendRoute{{url: c.PrometheusURL, target: target}}
+		}
+		return []backendRoute{c.routeOfRoot(name, target)}
+	}
+
+	first, rest := target, ""
+	if i := strings.IndexByte(target, '.'); i >= 0 {
+		first, rest = target[:i], target[i:]
+	}
+	if !strings.ContainsAny(first, "*?[{") {
+		return []backendRoute{c.routeOfRoot(first, target)}
+	}
+
+	routes := make([]backendRoute, 0)
+	if pattern, err := prometheus.GlobToRegexPattern(first); err == nil {
+		if re, err := regexp.Compile("^(?:" + pattern + ")$"); err == nil {
+			for _, backend := range c.Backends {
+				for _, root := range backend.Roots {
+					if re.MatchString(root) {
+						routes = append(routes, backendRoute{url: backend.url, target: root + rest})
+					}
+				}
+			}
+			for _, root := range c.PrometheusRoots {
+				if re.MatchString(root) {
+					routes = append(routes, backendRoute{url: c.PrometheusURL, target: root + rest})
+				}
+			}
+		}
+	}
+	if len(routes) == 0 {
+		return []backendRoute{{url: c.PrometheusURL, target: target}}
+	}
+	return routes
+}
+
+func (c *Config) routeOfRoot(root, target string) backendRoute {
+	for _, backend := range c.Backends {
+		for _, r := range backend.Roots {
+			if r == root {
+				return backendRoute{url: backend.url, target: target}
+			}
+		}
+	}
+	return backendRoute{url: c.PrometheusURL, target: target}
+}
+
+type backendKey struct{}
+
+// withBackend stores the url of the backend that the requests in ctx are sent to.
+func withBackend(ctx context.Context, url string) context.Context {
+	return context.WithValue(ctx, backendKey{}, url)
+}
+
+// backendURL returns the url of the backend in ctx, prometheus_url by default.
+func (w *Wrapper) backendURL(ctx context.Context) string {
+	if url, ok := ctx.Value(backendKey{}).(string); ok && url != "" {
+		return url
+	}
+	return w.configFrom(ctx).PrometheusURL
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_routesOf(t *testing.T) {
+	config := &Config{
+		PrometheusURL: "http://default/prometheus",
+		Backends: []*BackendConfig{
+			{URL: "http://a/prometheus", Roots: []string{"stats", "servers"}},
+			{URL: "http://b/", TenantID: "42", Roots: []string{"statsd"}, Patterns: []string{"servers.db*.*"}},
+		},
+	}
+	require.NoError(t, compileBackends(config.Backends))
+
+	assert.Equal(t, []backendRoute{{url: "http://a/prometheus", target: "stats.a.*"}}, config.routesOf("stats.a.*"))
+	assert.Equal(t, []backendRoute{{url: "http://b/select/42/prometheus", target: "servers.db1.cpu"}}, config.routesOf("servers.db1.cpu"))
+	assert.Equal(t, []backendRoute{{url: "http://a/prometheus", target: "servers.web1.cpu"}}, config.routesOf("servers.web1.cpu"))
+	assert.Equal(t, []backendRoute{{url: "http://default/prometheus", target: "other.a"}}, config.routesOf("other.a"))
+	assert.Equal(t, []backendRoute{{url: "http://b/select/42/prometheus", target: "seriesByTag('name=statsd', 'g1=a')"}},
+		config.routesOf("seriesByTag('name=statsd', 'g1=a')"))
+	assert.Equal(t, []backendRoute{
+		{url: "http://a/prometheus", target: "stats.a.*"},
+		{url: "http://b/select/42/prometheus", target: "statsd.a.*"},
+	}, config.routesOf("stats*.a.*"))
+
+	// The matching roots of prometheus_url are queried only when they're listed.
+	config.PrometheusRoots = []string{"statsfoo", "other"}
+	assert.Equal(t, []backendRoute{
+		{url: "http://a/prometheus", target: "stats.a.*"},
+		{url: "http://b/select/42/prometheus", target: "statsd.a.*"},
+		{url: "http://default/prometheus", target: "statsfoo.a.*"},
+	}, config.routesOf("stats*.a.*"))
+	assert.Equal(t, []backendRoute{{url: "http://default/prometheus", target: "x*.a"}}, config.routesOf("x*.a"))
+
+	assert.Error(t, compileBackends([]*BackendConfig{{Roots: []string{"a"}}}))
+	assert.Error(t, compileBackends([]*BackendConfig{{URL: "http://a", Roots: []string{"a.b"}}}))
+	assert.Error(t, compileBackends([]*BackendConfig{{URL: "http://a", Patterns: []string{"a.{b"}}}))
+}
+
+func TestWrapper_Find_backends(t *testing.T) {
+	newBackend := func(values string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"status":"success","data":` + values + `}`))
+		}))
+	}
+	a := newBackend(`["x","y"]`)
+	defer a.Close()
+	b := newBackend(`["y","z"]`)
+	defer b.Close()
+
+	config := &Config{
+		PrometheusMaxBody: 1024 * 1024,
+		FindCache:         FindCacheConfig{Size: 10, TTL: 60e9},
+		Backends: []*BackendConfig{
+			{URL: a.URL, Roots: []string{"stats"}},
+			{URL: b.URL, Roots: []string{"stats2"}},
+		},
+	}
+	require.NoError(t, compileBackends(config.Backends))
+	wrapper := newWrapper(config)
+
+	find := func(target string) []string {
+		resp, err := wrapper.Find(context.Background(), &protov3.MultiGlobRequest{Metrics: []string{target}})
+		require.NoError(t, err)
+		require.Len(t, resp.Metrics, 1)
+		paths := make([]string, 0)
+		for _, match := range resp.Metrics[0].Matches {
+			paths = append(paths, match.Path)
+		}
+		return paths
+	}
+	assert.Equal(t, []string{"stats.x", "stats.y"}, find("stats.*"))
+	assert.Equal(t, []string{"stats2.y", "stats2.z"}, find("stats2.*"))
+	assert.Equal(t, []string{"stats.x", "stats.y", "stats2.y", "stats2.z"}, find("stats*.*"))
+}
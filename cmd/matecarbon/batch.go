@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/zhihu/promate/prometheus"
+)
+
+// RenderBatchConfig merges the compatible targets of a render request into one union query,
+// the targets are compatible when they have the same name, backend, time range, step and rollup.
+type RenderBatchConfig struct {
+	// The maximum number of targets merged into a query, 0 or 1 disables batching.
+	MaxTargets int `yaml:"max_targets"`
+	// The maximum length of a merged query, 16384 by default, which is the -search.maxQueryLen of VictoriaMetrics.
+	MaxQueryLength int `yaml:"max_query_length"`
+}
+
+// renderPlan is a render target ready to be queried.
+type renderPlan struct {
+	request  protov3.FetchRequest
+	url      string
+	target   string
+	name     string
+	filters  prometheus.LabelFilters
+	query    string
+	rollup   rollup
+	interval float64
+	// The aligned range of the query, which is the requested range shifted forward by offset.
+	start int64
+	end   int64
+	step  int64
+	// The seconds that the query looks back, see timeShiftOf.
+	offset int64
+}
+
+type renderBatchKey struct {
+	url        string
+	name       string
+	start, end int64
+	step       int64
+	rollup     rollup
+	interval   float64
+	// The same series of different offsets are different series, but union would keep only one of them.
+	offset int64
+}
+
+// batchable reports whether the plan can be merged with others.
+// The series of seriesByTag are converted from the tags, and the series of histograms are named by the targets rather than the buckets,
+// so they can't be told apart by the paths. The batches are cached, so the plans which can't be cached aren't batched either.
+func (c RenderBatchConfig) batchable(plan *renderPlan) bool {
+	return c.MaxTargets > 1 && !prometheus.IsSeriesByTag(plan.target) && plan.rollup.Type != rollupTypeHistogram && plan.rollup.cacheable()
+}
+
+// group groups the compatible plans into batches of at most max_targets.
+func (c RenderBatchConfig) group(plans []*renderPlan) [][]*renderPlan {
+	maxLength := c.MaxQueryLength
+	if maxLength <= 0 {
+		maxLength = 16384
+	}
+
+	groups := make(map[renderBatchKey][]*renderPlan)
+	keys := make([]renderBatchKey, 0)
+	for _, plan := range plans {
+		key := renderBatchKey{
+			url:      plan.url,
+			name:     plan.name,
+			start:    plan.start,
+			end:      plan.end,
+			step:     plan.step,
+			rollup:   plan.rollup,
+			interval: plan.interval,
+			offset:   plan.offset,
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], plan)
+	}
+
+	batches := make([][]*renderPlan, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		// The same targets make the same query, so it can be cached.
+		sort.Slice(group, func(i, j int) bool { return group[i].query < group[j].query })
+
+		batch := make([]*renderPlan, 0, c.MaxTargets)
+		length := len("union()")
+		for _, plan := range group {
+			if len(batch) > 0 && (len(batch) >= c.MaxTargets || length+len(plan.query)+1 > maxLength) {
+				batches = append(batches, batch)
+				batch = make([]*renderPlan, 0, c.MaxTargets)
+				length = len("union()")
+			}
+			batch = append(batch, plan)
+			length += len(plan.query) + 1
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// fetchBatch queries the plans of a batch with a union query, and splits the series back to the plans by their label filters.
+// A series matching several plans is responded to each of them.
+func (w *Wrapper) fetchBatch(ctx context.Context, batch []*renderPlan) ([][]*renderSeries, error) {
+	first := batch[0]
+	if len(batch) == 1 {
+		series, err := w.fetchSeries(ctx, first.name, first.query, first.start, first.end, first.step)
+		return [][]*renderSeries{series}, err
+	}
+
+	queries := make([]string, 0, len(batch))
+	matchers := make([]*prometheus.PathMatcher, 0, len(batch))
+	for _, plan := range batch {
+		matcher, err := prometheus.NewPathMatcher(plan.name, plan.filters)
+		if err != nil {
+			return nil, fmt.Errorf("match %s failed %w", plan.target, err)
+		}
+		queries = append(queries, plan.query)
+		matchers = append(matchers, matcher)
+	}
+
+	query := "union(" + strings.Join(queries, ",") + ")"
+	series, err := w.fetchSeries(ctx, first.name, query, first.start, first.end, first.step)
+	if err != nil {
+		return nil, err
+	}
+	batchedQueries.Inc()
+	batchedTargets.Add(len(batch))
+
+	results := make([][]*renderSeries, len(batch))
+	for _, s := range series {
+		for i, matcher := range matchers {
+			if matcher.Match(s.Name) {
+				results[i] = append(results[i], s)
+			}
+		}
+	}
+	return results, nil
+}
+
+func batchPaths(batch []*renderPlan) []string {
+	paths := make([]string, 0, len(batch))
+	for _, plan := range batch {
+		paths = append(paths, plan.target)
+	}
+	return paths
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapper_Render_batch(t *testing.T) {
+	var queries int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		query := r.URL.Query().Get("query")
+		if strings.HasPrefix(query, "union(") {
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"__a_g1__":"b"},"values":[[1593561600,"1"]]},
+				{"metric":{"__a_g1__":"c"},"values":[[1593561600,"2"]]},
+				{"metric":{"__a_g1__":"d"},"values":[[1593561600,"3"]]}
+			]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"__x_g1__":"y"},"values":[[1593561600,"4"]]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		StatsdFlushInterval: 10,
+		DefaultRollupFunc:   "avg_over_time",
+		RenderBatch:         RenderBatchConfig{MaxTargets: 10},
+	})
+	multiResponse, err := wrapper.Render(context.Background(), &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{PathExpression: "a.b", StartTime: 1593561600, StopTime: 1593565200},
+			{PathExpression: "a.{c,d}", StartTime: 1593561600, StopTime: 1593565200},
+			{PathExpression: "a.*", StartTime: 1593561600, StopTime: 1593565200},
+			{PathExpression: "x.y", StartTime: 1593561600, StopTime: 1593565200},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	names := make(map[string][]string)
+	for _, metric := range multiResponse.Metrics {
+		names[metric.PathExpression] = append(names[metric.PathExpression], metric.Name)
+	}
+	for _, n := range names {
+		sort.Strings(n)
+	}
+	assert.Equal(t, map[string][]string{
+		"a.b":     {"a.b"},
+		"a.{c,d}": {"a.c", "a.d"},
+		"a.*":     {"a.b", "a.c", "a.d"},
+		"x.y":     {"x.y"},
+	}, names)
+}
+
+func TestRenderBatchConfig_group(t *testing.T) {
+	plan := func(name, query string, step int64) *renderPlan {
+		return &renderPlan{name: name, query: query, start: 100, end: 200, step: step}
+	}
+	plans := []*renderPlan{
+		plan("a", "q3", 10),
+		plan("a", "q1", 10),
+		plan("a", "q2", 10),
+		plan("a", "q4", 20),
+		plan("b", "q5", 10),
+	}
+
+	queries := func(batches [][]*renderPlan) [][]string {
+		result := make([][]string, 0, len(batches))
+		for _, batch := range batches {
+			qs := make([]string, 0, len(batch))
+			for _, p := range batch {
+				qs = append(qs, p.query)
+			}
+			result = append(result, qs)
+		}
+		return result
+	}
+
+	assert.Equal(t, [][]string{{"q1", "q2"}, {"q3"}, {"q4"}, {"q5"}}, queries(RenderBatchConfig{MaxTargets: 2}.group(plans)))
+	assert.Equal(t, [][]string{{"q1", "q2", "q3"}, {"q4"}, {"q5"}}, queries(RenderBatchConfig{MaxTargets: 10}.group(plans)))
+	// union(q1,q2,) is 15 bytes.
+	assert.Equal(t, [][]string{{"q1", "q2"}, {"q3"}, {"q4"}, {"q5"}}, queries(RenderBatchConfig{MaxTargets: 10, MaxQueryLength: 15}.group(plans)))
+
+	assert.False(t, RenderBatchConfig{}.batchable(&renderPlan{target: "a.b"}))
+	assert.True(t, RenderBatchConfig{MaxTargets: 2}.batchable(&renderPlan{target: "a.b"}))
+	assert.False(t, RenderBatchConfig{MaxTargets: 2}.batchable(&renderPlan{target: "seriesByTag('name=a')"}))
+}
+
+func TestWrapper_Render_batchConcurrent(t *testing.T) {
+	union := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if strings.HasPrefix(query, "union(") {
+			close(union)
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"__a_g1__":"b"},"values":[[1593561600,"1"]]},
+				{"metric":{"__a_g1__":"c"},"values":[[1593561600,"2"]]}
+			]}}`))
+			return
+		}
+		// The unbatched target responds only after the batch query starts.
+		select {
+		case <-union:
+		case <-time.After(2 * time.Second):
+			t.Error("the batch query waits for the unbatched fetch")
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"__x_g1__":"y"},"values":[[1593561600,"4"]]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	config := &Config{
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		StatsdFlushInterval: 10,
+		DefaultRollupFunc:   "avg_over_time",
+		RenderBatch:         RenderBatchConfig{MaxTargets: 10},
+		// The cumulative counters aren't cacheable, so they aren't batched.
+		RollupRules: []*RollupRule{{Pattern: "x.*", Type: "counter", Counter: "cumulative"}},
+	}
+	require.NoError(t, compileRollupRules(config.RollupRules))
+	wrapper := newWrapper(config)
+	multiResponse, err := wrapper.Render(context.Background(), &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{PathExpression: "x.y", StartTime: 1593561600, StopTime: 1593565200},
+			{PathExpression: "a.b", StartTime: 1593561600, StopTime: 1593565200},
+			{PathExpression: "a.c", StartTime: 1593561600, StopTime: 1593565200},
+		},
+	})
+	require.NoError(t, err)
+	assert.Len(t, multiResponse.Metrics, 3)
+}
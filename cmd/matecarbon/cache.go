@@ -0,0 +1,204 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// renderCache is a size bounded LRU cache of the series returned by the rollup queries.
+// Dashboards refresh the same range repeatedly, so the entry of a query is the step aligned series of the last range,
+// and the next request of the query only needs to fetch the points after it.
+type renderCache struct {
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type renderCacheEntry struct {
+	key    string
+	start  int64
+	end    int64
+	size   int64
+	series []*renderSeries
+}
+
+func newRenderCache(maxSize int64) *renderCache {
+	return &renderCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the series of key in the [start, end] range.
+// The values are only filled up to cachedEnd, the rest are NaN and should be fetched by the caller.
+// When nothing can be reused, cachedEnd is the point before start.
+func (c *renderCache) Get(key string, start, end, step int64) (series []*renderSeries, cachedEnd int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, start - step
+	}
+	entry := element.Value.(*renderCacheEntry)
+	// Only the head of the range can be reused, otherwise we need two queries and it's not worth it.
+	if entry.start > start || entry.end < start {
+		return nil, start - step
+	}
+	c.lru.MoveToFront(element)
+
+	cachedEnd = entry.end
+	if cachedEnd > end {
+		cachedEnd = end
+	}
+	offset := (start - entry.start) / step
+	length := (cachedEnd-start)/step + 1
+	count := (end-start)/step + 1
+
+	series = make([]*renderSeries, 0, len(entry.series))
+	for _, s := range entry.series {
+		values := makeNanArr(count)
+		copy(values, s.Values[offset:offset+length])
+		series = append(series, &renderSeries{
+			Name:   s.Name,
+			Values: values,
+		})
+	}
+	return series, cachedEnd
+}
+
+// Set replaces the entry of key with the series in the [start, end] range.
+func (c *renderCache) Set(key string, start, end, step int64, series []*renderSeries) {
+	if end < start {
+		return
+	}
+
+	length := (end-start)/step + 1
+	entry := &renderCacheEntry{
+		key:    key,
+		start:  start,
+		end:    end,
+		size:   int64(len(key)),
+		series: make([]*renderSeries, 0, len(series)),
+	}
+	for _, s := range series {
+		values := make([]float64, length)
+		copy(values, s.Values)
+		entry.series = append(entry.series, &renderSeries{
+			Name:   s.Name,
+			Values: values,
+		})
+		entry.size += int64(len(s.Name)) + length*8
+	}
+	if entry.size > c.maxSize {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += entry.size
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Purge removes all the entries.
+func (c *renderCache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.size = 0
+}
+
+func (c *renderCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*renderCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// lruCache is a LRU cache whose entries expire after ttl, such as the find matches and the discovered resolutions.
+type lruCache[V any] struct {
+	lock       sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	lru        *list.List
+	entries    map[string]*list.Element
+}
+
+type lruCacheEntry[V any] struct {
+	key    string
+	expire time.Time
+	value  V
+}
+
+func newLRUCache[V any](maxEntries int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value of key, it's shared by all callers and must not be modified.
+func (c *lruCache[V]) Get(key string) (V, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var zero V
+	element, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := element.Value.(*lruCacheEntry[V])
+	if time.Now().After(entry.expire) {
+		c.remove(element)
+		return zero, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.value, true
+}
+
+func (c *lruCache[V]) Set(key string, value V) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(&lruCacheEntry[V]{
+		key:    key,
+		expire: time.Now().Add(c.ttl),
+		value:  value,
+	})
+
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Purge removes all the entries.
+func (c *lruCache[V]) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *lruCache[V]) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*lruCacheEntry[V])
+	delete(c.entries, entry.key)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderCache(t *testing.T) {
+	nan := math.NaN()
+	cache := newRenderCache(1024)
+
+	series, cachedEnd := cache.Get("q", 100, 140, 10)
+	assert.Nil(t, series)
+	assert.Equal(t, int64(90), cachedEnd)
+
+	cache.Set("q", 100, 120, 10, []*renderSeries{
+		{Name: "a.b", Values: []float64{1, 2, 3, 4, 5}},
+	})
+
+	// The range after the cached end is filled with NaN.
+	series, cachedEnd = cache.Get("q", 110, 140, 10)
+	assert.Equal(t, int64(120), cachedEnd)
+	require.Len(t, series, 1)
+	assertValues(t, []float64{2, 3, nan, nan}, series[0].Values)
+
+	// The cached values are copied.
+	series[0].Values[0] = 0
+	series, _ = cache.Get("q", 110, 140, 10)
+	assertValues(t, []float64{2, 3, nan, nan}, series[0].Values)
+
+	// The range within the cache.
+	series, cachedEnd = cache.Get("q", 100, 110, 10)
+	assert.Equal(t, int64(110), cachedEnd)
+	assertValues(t, []float64{1, 2}, series[0].Values)
+
+	// The head of the range is missing.
+	series, cachedEnd = cache.Get("q", 90, 140, 10)
+	assert.Nil(t, series)
+	assert.Equal(t, int64(80), cachedEnd)
+
+	// Nothing can be reused.
+	series, cachedEnd = cache.Get("q", 130, 140, 10)
+	assert.Nil(t, series)
+	assert.Equal(t, int64(120), cachedEnd)
+}
+
+func TestRenderCache_Evict(t *testing.T) {
+	cache := newRenderCache(100)
+	values := []*renderSeries{{Name: "a", Values: []float64{1, 2, 3, 4, 5}}}
+
+	cache.Set("q1", 0, 40, 10, values)
+	cache.Set("q2", 0, 40, 10, values)
+	_, cachedEnd := cache.Get("q1", 0, 40, 10)
+	assert.Equal(t, int64(40), cachedEnd)
+
+	// q2 is the least recently used.
+	cache.Set("q3", 0, 40, 10, values)
+	_, cachedEnd = cache.Get("q2", 0, 40, 10)
+	assert.Equal(t, int64(-10), cachedEnd)
+	_, cachedEnd = cache.Get("q1", 0, 40, 10)
+	assert.Equal(t, int64(40), cachedEnd)
+	assert.True(t, cache.size <= cache.maxSize)
+
+	// Too large to be cached.
+	cache.Set("q4", 0, 200, 10, values)
+	_, cachedEnd = cache.Get("q4", 0, 200, 10)
+	assert.Equal(t, int64(-10), cachedEnd)
+}
+
+func TestLRUCache(t *testing.T) {
+	cache := newLRUCache[[]protov3.GlobMatch](2, time.Minute)
+	matches := []protov3.GlobMatch{{Path: "a.b"}}
+
+	_, ok := cache.Get("a.*")
+	assert.False(t, ok)
+
+	cache.Set("a.*", matches)
+	cache.Set("b.*", matches)
+	got, ok := cache.Get("a.*")
+	assert.True(t, ok)
+	assert.Equal(t, matches, got)
+
+	// b.* is the least recently used.
+	cache.Set("c.*", matches)
+	_, ok = cache.Get("b.*")
+	assert.False(t, ok)
+	_, ok = cache.Get("a.*")
+	assert.True(t, ok)
+
+	// Expired.
+	cache.entries["a.*"].Value.(*lruCacheEntry[[]protov3.GlobMatch]).expire = time.Now().Add(-time.Second)
+	_, ok = cache.Get("a.*")
+	assert.False(t, ok)
+	assert.Equal(t, 1, cache.lru.Len())
+}
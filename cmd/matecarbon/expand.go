@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/imroc/req"
+	"github.com/zhihu/promate/prometheus"
+)
+
+// The default maximum number of series that /metrics/expand and /metrics/index.json fetch from VictoriaMetrics.
+const defaultExpandMaxSeries = 100000
+
+type ExpandConfig struct {
+	// The maximum number of series fetched for a query, the request fails when the query matches more.
+	MaxSeries int `yaml:"max_series"`
+}
+
+// findSeries returns the paths of the series matching the glob query and its descendants.
+// The paths are fetched with /api/v1/series, which is bounded by the max_series of the expand config.
+func (w *Wrapper) findSeries(ctx context.Context, query string, start, stop int64) ([]string, error) {
+	// Same as Find, we can't query the full amount of metrics.
+	if strings.HasPrefix(query, "*") {
+		rootQueriesBlocked.Inc()
+		return nil, queryError{fmt.Errorf("can't query full amount metrics with %s", query)}
+	}
+
+	config := w.configFrom(ctx)
+	maxSeries := config.Expand.MaxSeries
+	if maxSeries <= 0 {
+		maxSeries = defaultExpandMaxSeries
+	}
+
+	// The query may span several backends, the series of them are merged.
+	paths := make([]string, 0)
+	for _, route := range config.routesOf(query) {
+		name, filters := prometheus.ConvertGraphiteTarget(route.target, false)
+		if name == "" {
+			return nil, queryError{fmt.Errorf("invalid query %s", query)}
+		}
+		// Ask for one more to know whether the result is truncated.
+		series, _, err := w.getSeries(withBackend(ctx, route.url), filters.Build(name), start, stop, maxSeries-len(paths)+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths)+len(series) > maxSeries {
+			return nil, queryError{fmt.Errorf("query %s matches more than %d series, please narrow it down", query, maxSeries)}
+		}
+
+		for _, metric := range series {
+			if path := prometheus.ConvertPrometheusMetric(name, metric); path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// getSeries returns the label sets of at most limit series matching the selector with /api/v1/series,
+// and reports whether they are partial.
+func (w *Wrapper) getSeries(ctx context.Context, selector string, start, stop int64, limit int) ([]map[string]string, bool, error) {
+	params := req.Param{
+		"match[]": selector,
+		"start":   start,
+		"end":     stop,
+		"limit":   limit,
+	}
+
+	release, err := w.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+
+	series := make([]map[string]string, 0)
+	seen := make(map[string]bool)
+	partial, err := w.get(ctx, "/api/v1/series", params, func(body io.Reader) (bool, error) {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return false, fmt.Errorf("read response failed %w", err)
+		}
+		observeResponseSize("series", int64(len(data)))
+
+		resp := new(prometheus.SeriesResponse)
+		err = json.Unmarshal(data, resp)
+		if err != nil {
+			return false, fmt.Errorf("unmarshal %s failed %w", string(data), err)
+		}
+		if resp.Status == "error" {
+			return false, fmt.Errorf("%s: %s", resp.ErrorType, resp.Error)
+		}
+		// Only the series of the previous replicas are deduplicated.
+		merged := len(series)
+		for _, metric := range resp.Data {
+			// fmt prints the maps sorted by key, so it identifies the label set.
+			key := fmt.Sprint(metric)
+			if merged > 0 && seen[key] {
+				continue
+			}
+			seen[key] = true
+			series = append(series, metric)
+		}
+		return resp.IsPartial, nil
+	})
+	return series, partial, err
+}
+
+// expandPaths returns the nodes at the depth of the query, which the paths are under.
+func expandPaths(query string, paths []string, leavesOnly bool) []string {
+	depth := strings.Count(query, ".") + 1
+
+	seen := make(map[string]bool, len(paths))
+	nodes := make([]string, 0, len(paths))
+	for _, path := range paths {
+		segments := strings.Split(path, ".")
+		// The trailing * of the query isn't filtered, so the shallower series are matched too.
+		if len(segments) < depth {
+			continue
+		}
+		if leavesOnly && len(segments) != depth {
+			continue
+		}
+		node := strings.Join(segments[:depth], ".")
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// expandHandler serves /metrics/expand?query=...&leavesOnly=0|1&groupByExpr=0|1.
+// It responds {"results": ["a.b", ...]}, or {"results": {"a.*": ["a.b", ...]}} when groupByExpr is set.
+func expandHandler(wrapper *Wrapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		queries := r.Form["query"]
+		if len(queries) == 0 {
+			http.Error(w, "missing parameter query", http.StatusBadRequest)
+			return
+		}
+		start, stop, err := parseTimeRange(r, "-24h")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		leavesOnly := parseBool(r.Form.Get("leavesOnly"))
+		groupByExpr := parseBool(r.Form.Get("groupByExpr"))
+
+		ctx := r.Context()
+		results := make([][]string, 0, len(queries))
+		for _, query := range queries {
+			paths, err := wrapper.findSeries(ctx, query, start, stop)
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			results = append(results, expandPaths(query, paths, leavesOnly))
+		}
+
+		buf := bytes.NewBufferString(`{"results":`)
+		if groupByExpr {
+			buf.WriteByte('{')
+			for i, query := range queries {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				key, _ := json.Marshal(query)
+				values, _ := json.Marshal(results[i])
+				buf.Write(key)
+				buf.WriteByte(':')
+				buf.Write(values)
+			}
+			buf.WriteByte('}')
+		} else {
+			seen := make(map[string]bool)
+			merged := make([]string, 0)
+			for _, nodes := range results {
+				for _, node := range nodes {
+					if !seen[node] {
+						seen[node] = true
+						merged = append(merged, node)
+					}
+				}
+			}
+			sort.Strings(merged)
+			values, _ := json.Marshal(merged)
+			buf.Write(values)
+		}
+		buf.WriteByte('}')
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(buf.Bytes())
+	}
+}
+
+// indexHandler serves /metrics/index.json?query=..., which lists all the leaf paths under the query.
+// Unlike graphite-web the query is required, listing the full amount of metrics is impossible.
+func indexHandler(wrapper *Wrapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query := r.Form.Get("query")
+		if query == "" {
+			http.Error(w, "missing parameter query", http.StatusBadRequest)
+			return
+		}
+		start, stop, err := parseTimeRange(r, "-24h")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		paths, err := wrapper.findSeries(ctx, query, start, stop)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		sort.Strings(paths)
+		writeJSON(w, paths)
+	}
+}
+
+func parseBool(s string) bool {
+	switch strings.ToLower(s) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
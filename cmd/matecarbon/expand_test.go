@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_expandPaths(t *testing.T) {
+	paths := []string{"a.b", "a.b.c", "a.b.d.e", "a.f.c"}
+	assert.Equal(t, []string{"a.b.c", "a.b.d", "a.f.c"}, expandPaths("a.*.*", paths, false))
+	assert.Equal(t, []string{"a.b.c", "a.f.c"}, expandPaths("a.*.*", paths, true))
+	assert.Equal(t, []string{"a.b", "a.f"}, expandPaths("a.*", paths, false))
+}
+
+func TestExpandHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/series", r.URL.Path)
+		assert.Equal(t, "4", r.URL.Query().Get("limit"))
+		switch r.URL.Query().Get("match[]") {
+		case `{__name__="a"}`:
+			_, _ = w.Write([]byte(`{"status":"success","data":[
+				{"__name__":"a","__a_g1__":"b","__a_g2__":"c"},
+				{"__name__":"a","__a_g1__":"b"},
+				{"__name__":"a","__a_g1__":"d","__a_g2__":"e"}
+			]}`))
+		case `{__name__="x"}`:
+			_, _ = w.Write([]byte(`{"status":"success","data":[{"__x_g1__":"y"}]}`))
+		default:
+			_, _ = w.Write([]byte(`{"status":"success","data":[{},{},{},{}]}`))
+		}
+	}))
+	defer server.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:     server.URL,
+		PrometheusMaxBody: 1024 * 1024,
+		Expand: ExpandConfig{
+			MaxSeries: 3,
+		},
+	})
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		url        string
+		wantStatus int
+		want       string
+	}{
+		{
+			name:       "expand",
+			handler:    expandHandler(wrapper),
+			url:        "/metrics/expand?query=a.*.*&query=x.*",
+			wantStatus: http.StatusOK,
+			want:       `{"results":["a.b.c","a.d.e","x.y"]}`,
+		},
+		{
+			name:       "expand leaves only",
+			handler:    expandHandler(wrapper),
+			url:        "/metrics/expand?query=a.*&leavesOnly=1",
+			wantStatus: http.StatusOK,
+			want:       `{"results":["a.b"]}`,
+		},
+		{
+			name:       "expand group by expr",
+			handler:    expandHandler(wrapper),
+			url:        "/metrics/expand?query=a.*&query=x.*&groupByExpr=1",
+			wantStatus: http.StatusOK,
+			want:       `{"results":{"a.*":["a.b","a.d"],"x.*":["x.y"]}}`,
+		},
+		{
+			name:       "too many series",
+			handler:    expandHandler(wrapper),
+			url:        "/metrics/expand?query=b.*",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "full amount",
+			handler:    expandHandler(wrapper),
+			url:        "/metrics/expand?query=*",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "index",
+			handler:    indexHandler(wrapper),
+			url:        "/metrics/index.json?query=a",
+			wantStatus: http.StatusOK,
+			want:       `["a.b","a.b.c","a.d.e"]`,
+		},
+		{
+			name:       "index without query",
+			handler:    indexHandler(wrapper),
+			url:        "/metrics/index.json",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			tt.handler(recorder, httptest.NewRequest("GET", tt.url, nil))
+			assert.Equal(t, tt.wantStatus, recorder.Code, recorder.Body.String())
+			if tt.want != "" {
+				assert.Equal(t, tt.want, recorder.Body.String())
+			}
+		})
+	}
+}
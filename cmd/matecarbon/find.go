@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/zhihu/promate/mateql"
+	"github.com/zhihu/promate/prometheus"
+)
+
+// The strategies of looking up the next segments of a find target.
+const (
+	// /api/v1/label/<label>/values with match[], which scans the whole label index of the segment.
+	findStrategyLabelValues = "label_values"
+	// /api/v1/series with a limit, which only reads the series under the target.
+	findStrategySeries = "series"
+	// The series strategy is used for the deep and selective targets, the label values strategy otherwise.
+	findStrategyAuto = "auto"
+)
+
+// FindConfig chooses how the next segments of a find target are looked up.
+type FindConfig struct {
+	// label_values, series, or auto by default.
+	Strategy string `yaml:"strategy"`
+	// In auto, the targets with at least this many segments use the series strategy, 4 by default.
+	SeriesMinDepth int `yaml:"series_min_depth"`
+	// In auto, the targets with more globs than this before the last segment use the label values strategy, 1 by default.
+	// A glob in the middle of a path multiplies the series under it, so the series strategy would mostly be truncated.
+	SeriesMaxGlobs int `yaml:"series_max_globs"`
+	// The maximum number of series fetched for a target, the matches are truncated beyond it. 10000 by default.
+	SeriesLimit int `yaml:"series_limit"`
+}
+
+func (c FindConfig) validate() error {
+	switch c.Strategy {
+	case "", findStrategyAuto, findStrategyLabelValues, findStrategySeries:
+		return nil
+	default:
+		return fmt.Errorf("find strategy %q is not one of auto, label_values and series", c.Strategy)
+	}
+}
+
+// strategyOf returns the strategy to look up the next segments of target.
+func (c FindConfig) strategyOf(target string) string {
+	nodes := strings.Split(target, ".")
+	// The label values of the second segment are fast, see lookupMatches.
+	if len(nodes) <= 2 {
+		return findStrategyLabelValues
+	}
+	switch c.Strategy {
+	case findStrategyLabelValues, findStrategySeries:
+		return c.Strategy
+	}
+
+	minDepth := c.SeriesMinDepth
+	if minDepth <= 0 {
+		minDepth = 4
+	}
+	maxGlobs := c.SeriesMaxGlobs
+	if maxGlobs <= 0 {
+		maxGlobs = 1
+	}
+	globs := 0
+	for _, node := range nodes[1 : len(nodes)-1] {
+		if strings.ContainsAny(node, "*?[{") {
+			globs++
+		}
+	}
+	if len(nodes) < minDepth || globs > maxGlobs {
+		return findStrategyLabelValues
+	}
+	return findStrategySeries
+}
+
+// findLookup is the matches of a target looked up from VictoriaMetrics.
+type findLookup struct {
+	matches []protov3.GlobMatch
+	// The partial responses and the truncated matches are incomplete, so they aren't cached.
+	partial   bool
+	truncated bool
+}
+
+// lookupSeriesMatches looks up the next segments of target from the series under it.
+// Unlike the label values, the series tell whether a path is a leaf, it is when no series goes deeper.
+// The matches are truncated when the target matches more than series_limit series.
+func (w *Wrapper) lookupSeriesMatches(ctx context.Context, target string, start, stop int64) (findLookup, error) {
+	limit := w.configFrom(ctx).Find.SeriesLimit
+	if limit <= 0 {
+		limit = 10000
+	}
+
+	name, filters := prometheus.ConvertGraphiteTarget(target, false)
+	prefix, label, _ := prometheus.ConvertQueryLabel(target)
+	depth := strings.Count(target, ".")
+	// The last segment must exist, the * of which is not converted to a filter.
+	filters = append(filters, mateql.LabelFilter{
+		Label:    label,
+		Value:    ".+",
+		IsRegexp: true,
+	})
+	next := prometheus.LabelName(name, depth+1)
+
+	series, partial, err := w.getSeries(ctx, filters.Build(name), start, stop, limit+1)
+	if err != nil {
+		return findLookup{}, err
+	}
+	truncated := len(series) > limit
+	if truncated {
+		findTruncated.Inc()
+		series = series[:limit]
+	}
+
+	index := make(map[string]int)
+	matches := make([]protov3.GlobMatch, 0)
+	for _, metric := range series {
+		path := prefix + metric[label]
+		_, isBranch := metric[next]
+
+		i, ok := index[path]
+		if !ok {
+			index[path] = len(matches)
+			matches = append(matches, protov3.GlobMatch{
+				IsLeaf: !isBranch,
+				Path:   path,
+			})
+			continue
+		}
+		if isBranch {
+			matches[i].IsLeaf = false
+		}
+	}
+	return findLookup{matches: matches, partial: partial, truncated: truncated}, nil
+}
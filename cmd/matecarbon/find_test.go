@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindConfig_strategyOf(t *testing.T) {
+	tests := []struct {
+		config FindConfig
+		target string
+		want   string
+	}{
+		{config: FindConfig{}, target: "a.*", want: findStrategyLabelValues},
+		{config: FindConfig{}, target: "a.b.*", want: findStrategyLabelValues},
+		{config: FindConfig{}, target: "a.b.c.*", want: findStrategySeries},
+		{config: FindConfig{}, target: "a.*.c.*", want: findStrategySeries},
+		{config: FindConfig{}, target: "a.*.*.*", want: findStrategyLabelValues},
+		{config: FindConfig{SeriesMaxGlobs: 2}, target: "a.*.*.*", want: findStrategySeries},
+		{config: FindConfig{SeriesMinDepth: 3}, target: "a.b.*", want: findStrategySeries},
+		{config: FindConfig{Strategy: findStrategyLabelValues}, target: "a.b.c.*", want: findStrategyLabelValues},
+		{config: FindConfig{Strategy: findStrategySeries}, target: "a.*.*.*", want: findStrategySeries},
+		{config: FindConfig{Strategy: findStrategySeries}, target: "a.*", want: findStrategyLabelValues},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.config.strategyOf(tt.target), "%+v %s", tt.config, tt.target)
+	}
+
+	assert.NoError(t, FindConfig{Strategy: "series"}.validate())
+	assert.Error(t, FindConfig{Strategy: "tree"}.validate())
+}
+
+func TestWrapper_lookupSeriesMatches(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		assert.Equal(t, "/api/v1/series", r.URL.Path)
+		assert.Equal(t, `{__name__="a",__a_g1__="b",__a_g2__="c",__a_g3__=~".+"}`, r.URL.Query().Get("match[]"))
+		assert.Equal(t, "5", r.URL.Query().Get("limit"))
+		_, _ = w.Write([]byte(`{"status":"success","data":[
+			{"__name__":"a","__a_g1__":"b","__a_g2__":"c","__a_g3__":"d"},
+			{"__name__":"a","__a_g1__":"b","__a_g2__":"c","__a_g3__":"e","__a_g4__":"x"},
+			{"__name__":"a","__a_g1__":"b","__a_g2__":"c","__a_g3__":"e","__a_g4__":"y"},
+			{"__name__":"a","__a_g1__":"b","__a_g2__":"c","__a_g3__":"f"},
+			{"__name__":"a","__a_g1__":"b","__a_g2__":"c","__a_g3__":"f","__a_g4__":"z"}
+		]}`))
+	}))
+	defer server.Close()
+
+	config := &Config{
+		PrometheusURL:     server.URL,
+		PrometheusMaxBody: 1024 * 1024,
+		Find:              FindConfig{SeriesLimit: 4},
+		FindCache:         FindCacheConfig{Size: 10, TTL: time.Minute},
+	}
+	wrapper := newWrapper(config)
+
+	truncated := findTruncated.Get()
+	lookup, err := wrapper.lookupMatches(context.Background(), "a.b.c.*", 100, 200)
+	require.NoError(t, err)
+	assert.Equal(t, []protov3.GlobMatch{
+		{Path: "a.b.c.d", IsLeaf: true},
+		{Path: "a.b.c.e", IsLeaf: false},
+		{Path: "a.b.c.f", IsLeaf: true},
+	}, lookup.matches)
+	assert.True(t, lookup.truncated)
+	assert.Equal(t, truncated+1, findTruncated.Get())
+
+	// The truncated matches aren't cached.
+	for i := 0; i < 2; i++ {
+		matches, truncated, err := wrapper.findMatches(context.Background(), "a.b.c.*", 100, 200)
+		require.NoError(t, err)
+		assert.Len(t, matches, 3)
+		assert.True(t, truncated)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/zhihu/promate/graphite"
+	"github.com/zhihu/promate/prometheus"
+)
+
+// The graphite-web compatible HTTP API, so simple scripts and the Graphite datasource of Grafana can query matecarbon without carbonapi.
+// https://graphite.readthedocs.io/en/latest/render_api.html
+// https://graphite.readthedocs.io/en/latest/metrics_api.html
+
+// graphiteRender serves /render?target=...&format=json|csv|raw|pickle.
+func graphiteRender(wrapper *Wrapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		multiRequest, err := parseRenderRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		format := r.Form.Get("format")
+		if format == "" {
+			format = "json"
+		}
+		writeFunc, ok := renderFormats[format]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unsupported format %s", format), http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		multiResponse, err := wrapper.Render(ctx, multiRequest)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeFunc(w, sortFetchResponses(multiRequest, multiResponse))
+	}
+}
+
+// parseRenderRequest parses the target, from, until and maxDataPoints parameters of the render API.
+func parseRenderRequest(r *http.Request) (*protov3.MultiFetchRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	targets := r.Form["target"]
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("missing parameter target")
+	}
+	for _, target := range targets {
+		// Graphite functions are left to carbonapi, only plain paths, globs and seriesByTag are supported.
+		if strings.ContainsAny(target, "()") && !prometheus.IsSeriesByTag(target) {
+			return nil, fmt.Errorf("graphite functions are not supported in target %s", target)
+		}
+	}
+
+	start, stop, err := parseTimeRange(r, "-24h")
+	if err != nil {
+		return nil, err
+	}
+
+	var maxDataPoints int64
+	if s := r.Form.Get("maxDataPoints"); s != "" {
+		maxDataPoints, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxDataPoints %s", s)
+		}
+	}
+
+	multiRequest := &protov3.MultiFetchRequest{
+		Metrics: make([]protov3.FetchRequest, 0, len(targets)),
+	}
+	for _, target := range targets {
+		multiRequest.Metrics = append(multiRequest.Metrics, protov3.FetchRequest{
+			Name:           target,
+			PathExpression: target,
+			StartTime:      start,
+			StopTime:       stop,
+			MaxDataPoints:  maxDataPoints,
+		})
+	}
+	return multiRequest, nil
+}
+
+// sortFetchResponses sorts the series by the order of the targets and then by name.
+// The targets are rendered concurrently, so the order of the response is random.
+func sortFetchResponses(multiRequest *protov3.MultiFetchRequest, multiResponse *protov3.MultiFetchResponse) []protov3.FetchResponse {
+	order := make(map[string]int, len(multiRequest.Metrics))
+	for i, request := range multiRequest.Metrics {
+		if _, ok := order[request.PathExpression]; !ok {
+			order[request.PathExpression] = i
+		}
+	}
+	metrics := multiResponse.Metrics
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[i].PathExpression != metrics[j].PathExpression {
+			return order[metrics[i].PathExpression] < order[metrics[j].PathExpression]
+		}
+		return metrics[i].Name < metrics[j].Name
+	})
+	return metrics
+}
+
+var renderFormats = map[string]func(w http.ResponseWriter, metrics []protov3.FetchResponse){
+	"json":   writeRenderJSON,
+	"csv":    writeRenderCSV,
+	"raw":    writeRenderRaw,
+	"pickle": writeRenderPickle,
+}
+
+// writeRenderJSON writes [{"target": "a.b", "tags": {"name": "a.b"}, "datapoints": [[1, 1593561600], [null, 1593561610]]}].
+func writeRenderJSON(w http.ResponseWriter, metrics []protov3.FetchResponse) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	buf.WriteByte('[')
+	for i, metric := range metrics {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(metric.Name)
+		buf.WriteString(`{"target":`)
+		buf.Write(name)
+		buf.WriteString(`,"tags":{"name":`)
+		buf.Write(name)
+		buf.WriteString(`},"datapoints":[`)
+		for j, value := range metric.Values {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('[')
+			// JSON doesn't support NaN and Inf, graphite-web writes null for them.
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				buf.WriteString("null")
+			} else {
+				buf.Write(strconv.AppendFloat(nil, value, 'f', -1, 64))
+			}
+			buf.WriteByte(',')
+			buf.WriteString(strconv.FormatInt(metric.StartTime+int64(j)*metric.StepTime, 10))
+			buf.WriteByte(']')
+		}
+		buf.WriteString(`]}`)
+	}
+	buf.WriteByte(']')
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// writeRenderCSV writes a line for each point, a.b,2020-07-01 08:00:00,1.
+func writeRenderCSV(w http.ResponseWriter, metrics []protov3.FetchResponse) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	for _, metric := range metrics {
+		for i, value := range metric.Values {
+			buf.WriteString(metric.Name)
+			buf.WriteByte(',')
+			buf.WriteString(time.Unix(metric.StartTime+int64(i)*metric.StepTime, 0).Format("2006-01-02 15:04:05"))
+			buf.WriteByte(',')
+			if !math.IsNaN(value) {
+				buf.Write(strconv.AppendFloat(nil, value, 'f', -1, 64))
+			}
+			buf.WriteByte('\n')
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// writeRenderRaw writes a line for each series, a.b,1593561600,1593561620,10|1,None.
+// As in graphite-web, the end time is exclusive.
+func writeRenderRaw(w http.ResponseWriter, metrics []protov3.FetchResponse) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	for _, metric := range metrics {
+		fmt.Fprintf(buf, "%s,%d,%d,%d|", metric.Name, metric.StartTime, metric.StopTime+metric.StepTime, metric.StepTime)
+		for i, value := range metric.Values {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if math.IsNaN(value) {
+				buf.WriteString("None")
+			} else {
+				buf.Write(strconv.AppendFloat(nil, value, 'f', -1, 64))
+			}
+		}
+		buf.WriteByte('\n')
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// writeRenderPickle writes the series in the same structure as the pickle format of graphite-web.
+func writeRenderPickle(w http.ResponseWriter, metrics []protov3.FetchResponse) {
+	series := make([]map[string]interface{}, 0, len(metrics))
+	for _, metric := range metrics {
+		series = append(series, map[string]interface{}{
+			"name":           metric.Name,
+			"pathExpression": metric.PathExpression,
+			"start":          metric.StartTime,
+			"end":            metric.StopTime + metric.StepTime,
+			"step":           metric.StepTime,
+			"values":         metric.Values,
+		})
+	}
+
+	blob, err := graphite.MarshalPickle(series)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pickle")
+	_, _ = w.Write(blob)
+}
+
+// graphiteFind serves /metrics/find?query=...&format=treejson|completer.
+func graphiteFind(wrapper *Wrapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		multiRequest, err := parseFindRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		format := r.Form.Get("format")
+		if format == "" {
+			format = "treejson"
+		}
+		if format != "treejson" && format != "completer" {
+			http.Error(w, fmt.Sprintf("unsupported format %s", format), http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		multiResponse, err := wrapper.Find(ctx, multiRequest)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		matches := sortGlobMatches(multiResponse)
+
+		var blob []byte
+		if format == "completer" {
+			blob, err = json.Marshal(completerResponse(matches))
+		} else {
+			blob, err = json.Marshal(treeJSONResponse(matches))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(blob)
+	}
+}
+
+// parseFindRequest parses the query, from and until parameters of the metrics find API.
+func parseFindRequest(r *http.Request) (*protov3.MultiGlobRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	query := r.Form.Get("query")
+	if query == "" {
+		return nil, fmt.Errorf("missing parameter query")
+	}
+
+	start, stop, err := parseTimeRange(r, "-24h")
+	if err != nil {
+		return nil, err
+	}
+
+	return &protov3.MultiGlobRequest{
+		Metrics:   []string{query},
+		StartTime: start,
+		StopTime:  stop,
+	}, nil
+}
+
+// sortGlobMatches flattens the matches of all queries and sorts them by path.
+func sortGlobMatches(multiResponse *protov3.MultiGlobResponse) []protov3.GlobMatch {
+	matches := make([]protov3.GlobMatch, 0)
+	for _, metric := range multiResponse.Metrics {
+		matches = append(matches, metric.Matches...)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Path < matches[j].Path })
+	return matches
+}
+
+type treeJSONNode struct {
+	AllowChildren int      `json:"allowChildren"`
+	Expandable    int      `json:"expandable"`
+	Leaf          int      `json:"leaf"`
+	ID            string   `json:"id"`
+	Text          string   `json:"text"`
+	Context       struct{} `json:"context"`
+}
+
+func treeJSONResponse(matches []protov3.GlobMatch) []treeJSONNode {
+	nodes := make([]treeJSONNode, 0, len(matches))
+	for _, match := range matches {
+		node := treeJSONNode{
+			ID:   match.Path,
+			Text: lastNode(match.Path),
+		}
+		if match.IsLeaf {
+			node.Leaf = 1
+		} else {
+			node.AllowChildren = 1
+			node.Expandable = 1
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+type completerMetric struct {
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	IsLeaf string `json:"is_leaf"`
+}
+
+type completer struct {
+	Metrics []completerMetric `json:"metrics"`
+}
+
+func completerResponse(matches []protov3.GlobMatch) completer {
+	metrics := make([]completerMetric, 0, len(matches))
+	for _, match := range matches {
+		metric := completerMetric{
+			Path:   match.Path,
+			Name:   lastNode(match.Path),
+			IsLeaf: "1",
+		}
+		if !match.IsLeaf {
+			metric.Path += "."
+			metric.IsLeaf = "0"
+		}
+		metrics = append(metrics, metric)
+	}
+	return completer{Metrics: metrics}
+}
+
+func lastNode(path string) string {
+	return path[strings.LastIndexByte(path, '.')+1:]
+}
+
+// parseTimeRange parses the from and until parameters, until defaults to now.
+func parseTimeRange(r *http.Request, defaultFrom string) (start, stop int64, err error) {
+	now := time.Now()
+	from := r.Form.Get("from")
+	if from == "" {
+		from = defaultFrom
+	}
+	start, err = graphite.ParseTime(from, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	stop, err = graphite.ParseTime(r.Form.Get("until"), now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start >= stop {
+		return 0, 0, fmt.Errorf("from %s must be before until %s", from, r.Form.Get("until"))
+	}
+	return start, stop, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newGraphiteTestWrapper(t *testing.T) (*Wrapper, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/query_range":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"__a_g1__":"c"},"values":[[1593561600,"3"]]},
+				{"metric":{"__a_g1__":"b"},"values":[[1593561600,"1"],[1593561620,"2.5"]]}
+			]}}`))
+		case "/api/v1/label/__a_g1__/values":
+			_, _ = w.Write([]byte(`{"status":"success","data":["c","b"]}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	wrapper := newWrapper(&Config{
+		StatsdFlushInterval: 10,
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		DefaultRollupFunc:   "avg_over_time",
+	})
+	return wrapper, server.Close
+}
+
+func TestGraphiteRender(t *testing.T) {
+	wrapper, stop := newGraphiteTestWrapper(t)
+	defer stop()
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		want       string
+	}{
+		{
+			name:       "json",
+			query:      "target=a.*&from=1593561600&until=1593561620",
+			wantStatus: http.StatusOK,
+			want: `[{"target":"a.b","tags":{"name":"a.b"},"datapoints":[[1,1593561600],[null,1593561610],[2.5,1593561620]]},` +
+				`{"target":"a.c","tags":{"name":"a.c"},"datapoints":[[3,1593561600],[null,1593561610],[null,1593561620]]}]`,
+		},
+		{
+			name:       "raw",
+			query:      "target=a.*&from=1593561600&until=1593561620&format=raw",
+			wantStatus: http.StatusOK,
+			want:       "a.b,1593561600,1593561630,10|1,None,2.5\na.c,1593561600,1593561630,10|3,None,None\n",
+		},
+		{
+			name:       "missing target",
+			query:      "from=-1h",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "function",
+			query:      "target=sumSeries(a.*)",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown format",
+			query:      "target=a.*&format=png",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid time range",
+			query:      "target=a.*&from=now&until=-1h",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			graphiteRender(wrapper)(recorder, httptest.NewRequest("GET", "/render?"+tt.query, nil))
+			assert.Equal(t, tt.wantStatus, recorder.Code)
+			if tt.want != "" {
+				assert.Equal(t, tt.want, recorder.Body.String())
+			}
+		})
+	}
+
+	// Grafana posts the parameters as a form.
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/render", strings.NewReader("target=a.*&from=1593561600&until=1593561620&format=csv"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	graphiteRender(wrapper)(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 6, strings.Count(recorder.Body.String(), "\n"))
+}
+
+func TestGraphiteFind(t *testing.T) {
+	wrapper, stop := newGraphiteTestWrapper(t)
+	defer stop()
+
+	recorder := httptest.NewRecorder()
+	graphiteFind(wrapper)(recorder, httptest.NewRequest("GET", "/metrics/find?query=a.*", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `[
+		{"allowChildren":1,"expandable":1,"leaf":0,"id":"a.b","text":"b","context":{}},
+		{"allowChildren":1,"expandable":1,"leaf":0,"id":"a.c","text":"c","context":{}}
+	]`, recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	graphiteFind(wrapper)(recorder, httptest.NewRequest("GET", "/metrics/find?query=a.*&format=completer", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"metrics":[
+		{"path":"a.b.","name":"b","is_leaf":"0"},
+		{"path":"a.c.","name":"c","is_leaf":"0"}
+	]}`, recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	graphiteFind(wrapper)(recorder, httptest.NewRequest("GET", "/metrics/find", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zhihu/promate/prometheus"
+)
+
+// GuardrailsConfig limits the expensive queries before they reach VictoriaMetrics, 0 means unlimited.
+type GuardrailsConfig struct {
+	// The maximum number of series of a render target, checked with /api/v1/series before querying.
+	MaxSeries int `yaml:"max_series"`
+	// The maximum number of points of a render target, the series times the points per series.
+	MaxPoints int64 `yaml:"max_points"`
+	// The maximum time range of a render target.
+	MaxTimeRange time.Duration `yaml:"max_time_range"`
+	// The limits of the paths under a prefix, the longest matching prefix overrides the limits above.
+	Prefixes []*PrefixGuardrail `yaml:"prefixes"`
+}
+
+type PrefixGuardrail struct {
+	// The prefix of the path expression, such as stats.timers.
+	Prefix       string        `yaml:"prefix"`
+	MaxSeries    int           `yaml:"max_series"`
+	MaxPoints    int64         `yaml:"max_points"`
+	MaxTimeRange time.Duration `yaml:"max_time_range"`
+	// The regular expressions of the denied path expressions under the prefix, such as ^stats\.timers\.\*.
+	// They are matched against the expressions of both find and render.
+	Deny []string `yaml:"deny"`
+
+	denyRes []*regexp.Regexp
+}
+
+// guardrail is the limits of a target.
+type guardrail struct {
+	prefix       string
+	maxSeries    int
+	maxPoints    int64
+	maxTimeRange time.Duration
+}
+
+func compileGuardrails(config *GuardrailsConfig) error {
+	for _, prefix := range config.Prefixes {
+		prefix.denyRes = make([]*regexp.Regexp, 0, len(prefix.Deny))
+		for _, deny := range prefix.Deny {
+			re, err := regexp.Compile(deny)
+			if err != nil {
+				return fmt.Errorf("guardrail of prefix %q: %w", prefix.Prefix, err)
+			}
+			prefix.denyRes = append(prefix.denyRes, re)
+		}
+	}
+	return nil
+}
+
+// guardrailOf returns the limits of the target, or a queryError if it's denied.
+func (c *GuardrailsConfig) guardrailOf(target string) (guardrail, error) {
+	g := guardrail{
+		maxSeries:    c.MaxSeries,
+		maxPoints:    c.MaxPoints,
+		maxTimeRange: c.MaxTimeRange,
+	}
+
+	var matched *PrefixGuardrail
+	for _, prefix := range c.Prefixes {
+		if !strings.HasPrefix(target, prefix.Prefix) {
+			continue
+		}
+		for _, re := range prefix.denyRes {
+			if re.MatchString(target) {
+				return g, queryError{fmt.Errorf("%s is denied by %s under prefix %q", target, re, prefix.Prefix)}
+			}
+		}
+		if matched == nil || len(prefix.Prefix) > len(matched.Prefix) {
+			matched = prefix
+		}
+	}
+
+	if matched != nil {
+		g.prefix = matched.Prefix
+		if matched.MaxSeries > 0 {
+			g.maxSeries = matched.MaxSeries
+		}
+		if matched.MaxPoints > 0 {
+			g.maxPoints = matched.MaxPoints
+		}
+		if matched.MaxTimeRange > 0 {
+			g.maxTimeRange = matched.MaxTimeRange
+		}
+	}
+	return g, nil
+}
+
+// checkTarget returns the limits of the render target, or a queryError if it's denied or its time range exceeds the limit.
+// It doesn't query VictoriaMetrics, so it's checked before any query of the target.
+func (c *GuardrailsConfig) checkTarget(target string, start, end int64) (guardrail, error) {
+	g, err := c.guardrailOf(target)
+	if err != nil {
+		return g, err
+	}
+
+	timeRange := time.Duration(end-start) * time.Second
+	if g.maxTimeRange > 0 && timeRange > g.maxTimeRange {
+		return g, queryError{fmt.Errorf("time range %s of %s exceeds the limit %s%s", timeRange, target, g.maxTimeRange, g.describe())}
+	}
+	return g, nil
+}
+
+// checkRender returns a queryError if the render target exceeds the points or series limits of g, which depend on the step.
+// The series are only counted when the target is a glob or seriesByTag, a plain path matches one series at most.
+func (w *Wrapper) checkRender(ctx context.Context, g guardrail, target, selector string, start, end, step int64) error {
+	points := (end-start)/step + 1
+	if g.maxPoints > 0 && points > g.maxPoints {
+		return queryError{fmt.Errorf("%s has %d points per series, exceeds the limit %d%s", target, points, g.maxPoints, g.describe())}
+	}
+
+	// The number of series is bounded by both limits, so a single request checks them.
+	limit := g.maxSeries
+	if g.maxPoints > 0 && (limit <= 0 || int(g.maxPoints/points) < limit) {
+		limit = int(g.maxPoints / points)
+	}
+	if limit <= 0 || !(prometheus.IsSeriesByTag(target) || strings.ContainsAny(target, "*?[{")) {
+		return nil
+	}
+
+	series, _, err := w.getSeries(ctx, selector, start, end, limit+1)
+	if err != nil {
+		return err
+	}
+	if len(series) <= limit {
+		return nil
+	}
+	if g.maxSeries > 0 && len(series) > g.maxSeries {
+		return queryError{fmt.Errorf("%s matches more than %d series%s, please narrow it down", target, g.maxSeries, g.describe())}
+	}
+	return queryError{fmt.Errorf("%s matches more than %d series of %d points, exceeds the limit %d points%s", target, limit, points, g.maxPoints, g.describe())}
+}
+
+func (g guardrail) describe() string {
+	if g.prefix == "" {
+		return ""
+	}
+	return fmt.Sprintf(" of prefix %q", g.prefix)
+}
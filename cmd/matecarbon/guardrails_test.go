@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuardrailsConfig_guardrailOf(t *testing.T) {
+	config := &GuardrailsConfig{
+		MaxSeries:    100,
+		MaxTimeRange: 24 * time.Hour,
+		Prefixes: []*PrefixGuardrail{
+			{Prefix: "stats.", MaxSeries: 10, Deny: []string{`^stats\.\*`}},
+			{Prefix: "stats.timers.", MaxTimeRange: time.Hour},
+		},
+	}
+	require.NoError(t, compileGuardrails(config))
+
+	g, err := config.guardrailOf("servers.*.cpu")
+	require.NoError(t, err)
+	assert.Equal(t, guardrail{maxSeries: 100, maxTimeRange: 24 * time.Hour}, g)
+
+	g, err = config.guardrailOf("stats.timers.*.count")
+	require.NoError(t, err)
+	assert.Equal(t, guardrail{prefix: "stats.timers.", maxSeries: 100, maxTimeRange: time.Hour}, g)
+
+	_, err = config.guardrailOf("stats.*.api.count")
+	assert.True(t, isQueryError(err))
+
+	assert.Error(t, compileGuardrails(&GuardrailsConfig{Prefixes: []*PrefixGuardrail{{Deny: []string{"("}}}}))
+}
+
+func TestWrapper_checkRender(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/series", r.URL.Path)
+		_, _ = w.Write([]byte(`{"status":"success","data":[{"__name__":"a","__name_g1__":"b"},{"__name__":"a","__name_g1__":"c"},{"__name__":"a","__name_g1__":"d"}]}`))
+	}))
+	defer server.Close()
+
+	config := &Config{
+		StatsdFlushInterval: 10,
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		DefaultRollupFunc:   "avg_over_time",
+		Guardrails: GuardrailsConfig{
+			MaxSeries:    2,
+			MaxPoints:    1000,
+			MaxTimeRange: 24 * time.Hour,
+		},
+	}
+	wrapper := newWrapper(config)
+	ctx := context.Background()
+	selector := `a{__name_g1__=~".*"}`
+
+	check := func(target, selector string, start, end, step int64) error {
+		g, err := config.Guardrails.checkTarget(target, start, end)
+		if err != nil {
+			return err
+		}
+		return wrapper.checkRender(ctx, g, target, selector, start, end, step)
+	}
+
+	// A plain path isn't counted.
+	assert.NoError(t, check("a.b", `a{__name_g1__="b"}`, 0, 3600, 10))
+	assert.EqualError(t, check("a.*", selector, 0, 3600, 10), "a.* matches more than 2 series, please narrow it down")
+	assert.EqualError(t, check("a.b", selector, 0, 2*86400, 600), "time range 48h0m0s of a.b exceeds the limit 24h0m0s")
+	assert.EqualError(t, check("a.b", selector, 0, 86400, 60), "a.b has 1441 points per series, exceeds the limit 1000")
+
+	config.Guardrails.MaxSeries = 0
+	assert.EqualError(t, check("a.*", selector, 0, 3600, 10), "a.* matches more than 2 series of 361 points, exceeds the limit 1000 points")
+	assert.NoError(t, check("a.*", selector, 0, 3600, 60))
+
+	_, err := wrapper.Render(ctx, &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{PathExpression: "a.*", StartTime: 0, StopTime: 2 * 86400},
+		},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, errorStatus(err))
+}
+
+func TestWrapper_Render_guardrailsBeforeQuerying(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+
+	config := &Config{
+		StatsdFlushInterval: 10,
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		DefaultRollupFunc:   "avg_over_time",
+		ResolutionDiscovery: ResolutionDiscoveryConfig{Enabled: true},
+		Guardrails: GuardrailsConfig{
+			Prefixes: []*PrefixGuardrail{{Prefix: "stats.", MaxTimeRange: time.Hour, Deny: []string{`^stats\.\*`}}},
+		},
+	}
+	require.NoError(t, compileGuardrails(&config.Guardrails))
+	wrapper := newWrapper(config)
+
+	// Neither the resolution is discovered nor the series are counted.
+	for _, request := range []protov3.FetchRequest{
+		{PathExpression: "stats.*.a", StartTime: 0, StopTime: 600},
+		{PathExpression: "stats.a.*", StartTime: 0, StopTime: 86400},
+	} {
+		_, err := wrapper.Render(context.Background(), &protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{request}})
+		assert.True(t, isQueryError(err), request.PathExpression)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/imroc/req"
+	log "github.com/sirupsen/logrus"
+)
+
+// HAConfig controls the reads from the replicas of a backend, which are equivalent vmselect nodes or clusters.
+type HAConfig struct {
+	// A hedged request is sent to the next replica when a request takes longer than this percentile
+	// of the recent latencies of the same API of the backend, such as 0.95. 0 disables hedging.
+	HedgePercentile float64 `yaml:"hedge_percentile"`
+	// The minimum delay before the hedged request, 50ms by default.
+	MinHedgeDelay time.Duration `yaml:"min_hedge_delay"`
+	// A replica is ejected after this many consecutive failures, 0 disables ejection.
+	MaxFailures int `yaml:"max_failures"`
+	// How long an ejected replica isn't used, 30s by default.
+	EjectDuration time.Duration `yaml:"eject_duration"`
+	// When a replica responds partial results, the request is sent to the next replica too and the results are merged.
+	// Otherwise the partial results are used as is.
+	MergePartial bool `yaml:"merge_partial"`
+}
+
+// The number of recent latencies that the hedge delay is computed from.
+const latencyWindowSize = 1024
+
+// replicaSet is the replicas of a backend, they are tried in round robin order.
+type replicaSet struct {
+	replicas []*replica
+	next     uint32
+
+	// The latencies of each API, as the lookups of the labels are much faster than query_range.
+	lock    sync.Mutex
+	windows map[string]*latencyWindow
+}
+
+// latencyWindow is the recent latencies of an API.
+type latencyWindow struct {
+	latencies []time.Duration
+	cursor    int
+}
+
+type replica struct {
+	url string
+
+	lock         sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+}
+
+func newReplicaSet(urls []string) *replicaSet {
+	set := &replicaSet{
+		replicas: make([]*replica, 0, len(urls)),
+		windows:  make(map[string]*latencyWindow),
+	}
+	for _, url := range urls {
+		set.replicas = append(set.replicas, &replica{url: url})
+	}
+	return set
+}
+
+// order returns the replicas to try, the ejected ones are skipped unless all of them are ejected.
+func (s *replicaSet) order() []*replica {
+	start := int(atomic.AddUint32(&s.next, 1))
+	now := time.Now()
+
+	healthy := make([]*replica, 0, len(s.replicas))
+	for i := range s.replicas {
+		r := s.replicas[(start+i)%len(s.replicas)]
+		if !r.ejected(now) {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		for i := range s.replicas {
+			healthy = append(healthy, s.replicas[(start+i)%len(s.replicas)])
+		}
+	}
+	return healthy
+}
+
+// apiOf returns the API of the request path, the label values of all labels are the same API.
+func apiOf(path string) string {
+	if strings.HasPrefix(path, "/api/v1/label/") {
+		return "/api/v1/label/values"
+	}
+	return path
+}
+
+func (s *replicaSet) observe(path string, latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	api := apiOf(path)
+	window, ok := s.windows[api]
+	if !ok {
+		window = &latencyWindow{latencies: make([]time.Duration, 0, latencyWindowSize)}
+		s.windows[api] = window
+	}
+	if len(window.latencies) < latencyWindowSize {
+		window.latencies = append(window.latencies, latency)
+		return
+	}
+	window.latencies[window.cursor] = latency
+	window.cursor = (window.cursor + 1) % latencyWindowSize
+}
+
+// percentile returns the latency percentile of the recent requests of the API of path, 0 when there isn't enough data.
+func (s *replicaSet) percentile(path string, p float64) time.Duration {
+	s.lock.Lock()
+	var latencies []time.Duration
+	if window, ok := s.windows[apiOf(path)]; ok {
+		latencies = append(latencies, window.latencies...)
+	}
+	s.lock.Unlock()
+
+	if len(latencies) < 10 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[int(p*float64(len(latencies)-1))]
+}
+
+func (r *replica) ejected(now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return now.Before(r.ejectedUntil)
+}
+
+// record updates the health of the replica, it's ejected after too many consecutive failures.
+func (r *replica) record(err error, config HAConfig) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err == nil {
+		r.failures = 0
+		return
+	}
+	r.failures++
+	if config.MaxFailures > 0 && r.failures >= config.MaxFailures {
+		duration := config.EjectDuration
+		if duration <= 0 {
+			duration = 30 * time.Second
+		}
+		r.ejectedUntil = time.Now().Add(duration)
+		r.failures = 0
+		replicaEjections.Inc()
+		log.Warnf("replica %s is ejected for %s after %d failures, last error %s", r.url, duration, config.MaxFailures, err)
+	}
+}
+
+// replicaSetOf returns the replicas of the backend url, which are created on first use.
+func (w *Wrapper) replicaSetOf(config *Config, url string) *replicaSet {
+	urls := config.replicasOf(url)
+	key := strings.Join(urls, ",")
+
+	w.replicaLock.Lock()
+	defer w.replicaLock.Unlock()
+
+	if w.replicaSets == nil {
+		w.replicaSets = make(map[string]*replicaSet)
+	}
+	set, ok := w.replicaSets[key]
+	if !ok {
+		set = newReplicaSet(urls)
+		w.replicaSets[key] = set
+	}
+	return set
+}
+
+// replicasOf returns the urls of the replicas of the backend url, the url itself is the first one.
+func (c *Config) replicasOf(url string) []string {
+	if url == c.PrometheusURL {
+		return append([]string{url}, c.PrometheusReplicas...)
+	}
+	for _, backend := range c.Backends {
+		if backend.url == url {
+			return append([]string{url}, backend.replicaURLs...)
+		}
+	}
+	return []string{url}
+}
+
+// get sends the GET request of path to the replicas of the backend in ctx, and calls decode with the response body.
+// A failed replica falls back to the next one. When decode reports that the results are partial and merge_partial is enabled,
+// the request is sent to the next replica and decode is called again, so decode must merge the results.
+// It reports whether the results are still partial in the end, which mustn't be cached.
+func (w *Wrapper) get(ctx context.Context, path string, params req.Param, decode func(body io.Reader) (partial bool, err error)) (bool, error) {
+	config := w.configFrom(ctx)
+	params, err := withTimeoutParam(ctx, params)
+	if err != nil {
+		return false, err
+	}
+	replicas := w.replicaSetOf(config, w.backendURL(ctx))
+	order := replicas.order()
+
+	var lastErr error
+	merged, partial := false, false
+	for tried := 0; tried < len(order); {
+		resp, cancel, used, err := w.hedge(ctx, replicas, order[tried:], path, params)
+		tried += used
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return false, err
+			}
+			continue
+		}
+
+		partial, err = func() (bool, error) {
+			defer cancel()
+			defer func() { _ = resp.Response().Body.Close() }()
+			return decode(io.LimitReader(resp.Response().Body, config.PrometheusMaxBody))
+		}()
+		if err != nil {
+			return false, err
+		}
+		merged = true
+		if !partial || !config.HA.MergePartial {
+			return partial, nil
+		}
+		partialResponses.Inc()
+	}
+	if merged {
+		return partial, nil
+	}
+	return false, lastErr
+}
+
+type hedgeResult struct {
+	index  int
+	resp   *req.Resp
+	cancel context.CancelFunc
+	err    error
+}
+
+// hedge requests the first replica, and the second one too if the first doesn't respond within the hedge delay.
+// It returns the first successful response and how many replicas are used, the cancel must be called after reading the response.
+func (w *Wrapper) hedge(ctx context.Context, replicas *replicaSet, order []*replica, path string, params req.Param) (*req.Resp, context.CancelFunc, int, error) {
+	config := w.configFrom(ctx).HA
+	results := make(chan hedgeResult, 2)
+	var cancels [2]context.CancelFunc
+	send := func(index int) {
+		r := order[index]
+		ctx, cancel := context.WithCancel(ctx)
+		cancels[index] = cancel
+		go func() {
+			startTime := time.Now()
+			resp, err := w.request.Get(r.url+path, ctx, params)
+			if err == nil && resp.Response().StatusCode >= 500 {
+				body, _ := ioutil.ReadAll(io.LimitReader(resp.Response().Body, 1024))
+				_ = resp.Response().Body.Close()
+				err = fmt.Errorf("%s responded %d %s", r.url, resp.Response().StatusCode, body)
+			}
+			if err == nil {
+				replicas.observe(path, time.Since(startTime))
+			}
+			// The losers of the hedged requests are canceled, which isn't the fault of the replica.
+			if !errors.Is(err, context.Canceled) {
+				r.record(err, config)
+			}
+			results <- hedgeResult{index: index, resp: resp, cancel: cancel, err: err}
+		}()
+	}
+
+	send(0)
+	if config.HedgePercentile <= 0 || len(order) == 1 {
+		result := <-results
+		if result.err != nil {
+			result.cancel()
+		}
+		return result.resp, result.cancel, 1, result.err
+	}
+
+	delay := replicas.percentile(path, config.HedgePercentile)
+	minDelay := config.MinHedgeDelay
+	if minDelay <= 0 {
+		minDelay = 50 * time.Millisecond
+	}
+	if delay < minDelay {
+		delay = minDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			result.cancel()
+		}
+		// When the first replica fails before the delay, the next one is a fallback rather than a hedge.
+		return result.resp, result.cancel, 1, result.err
+	case <-timer.C:
+		hedgedRequests.Inc()
+		send(1)
+	}
+
+	result := <-results
+	if result.err != nil {
+		result.cancel()
+		// The other one is the last chance.
+		result = <-results
+		if result.err != nil {
+			result.cancel()
+		}
+		return result.resp, result.cancel, 2, result.err
+	}
+
+	// Cancel the slower one, and release it in the background.
+	cancels[1-result.index]()
+	go func() {
+		loser := <-results
+		if loser.err == nil {
+			_ = loser.resp.Response().Body.Close()
+		}
+		loser.cancel()
+	}()
+	return result.resp, result.cancel, 2, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapper_get_fallback(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer broken.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"success","data":["b","c"]}`))
+	}))
+	defer healthy.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:      broken.URL,
+		PrometheusReplicas: []string{healthy.URL},
+		PrometheusMaxBody:  1024 * 1024,
+		HA:                 HAConfig{MaxFailures: 1, EjectDuration: time.Minute},
+	})
+
+	for i := 0; i < 4; i++ {
+		values, _, err := wrapper.getValues(context.Background(), "/api/v1/labels", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b", "c"}, values)
+	}
+
+	replicas := wrapper.replicaSetOf(wrapper.Config(), broken.URL)
+	assert.True(t, replicas.replicas[0].ejected(time.Now()))
+	assert.False(t, replicas.replicas[1].ejected(time.Now()))
+	for i := 0; i < 4; i++ {
+		order := replicas.order()
+		require.Len(t, order, 1)
+		assert.Equal(t, healthy.URL, order[0].url)
+	}
+}
+
+func TestWrapper_hedge(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:      slow.URL,
+		PrometheusReplicas: []string{fast.URL},
+		PrometheusMaxBody:  1024 * 1024,
+		HA:                 HAConfig{HedgePercentile: 0.9, MinHedgeDelay: 20 * time.Millisecond},
+	})
+	replicas := wrapper.replicaSetOf(wrapper.Config(), slow.URL)
+
+	hedged := hedgedRequests.Get()
+	startTime := time.Now()
+	resp, cancel, used, err := wrapper.hedge(context.Background(), replicas, replicas.replicas, "/", nil)
+	require.NoError(t, err)
+	defer cancel()
+	body, err := ioutil.ReadAll(resp.Response().Body)
+	require.NoError(t, err)
+	_ = resp.Response().Body.Close()
+
+	assert.Equal(t, "fast", string(body))
+	assert.Equal(t, 2, used)
+	assert.Equal(t, hedged+1, hedgedRequests.Get())
+	assert.Less(t, int64(time.Since(startTime)), int64(time.Second))
+}
+
+func TestWrapper_get_mergePartial(t *testing.T) {
+	newReplica := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(body))
+		}))
+	}
+	a := newReplica(`{"status":"success","isPartial":true,"data":{"resultType":"matrix","result":[
+		{"metric":{"__a_g1__":"b"},"values":[[1593561600,"1"]]}
+	]}}`)
+	defer a.Close()
+	b := newReplica(`{"status":"success","isPartial":true,"data":{"resultType":"matrix","result":[
+		{"metric":{"__a_g1__":"b"},"values":[[1593561610,"2"]]},
+		{"metric":{"__a_g1__":"c"},"values":[[1593561600,"3"]]}
+	]}}`)
+	defer b.Close()
+
+	config := &Config{
+		PrometheusURL:      a.URL,
+		PrometheusReplicas: []string{b.URL},
+		PrometheusMaxBody:  1024 * 1024,
+		HA:                 HAConfig{MergePartial: true},
+	}
+	wrapper := newWrapper(config)
+
+	series, _, err := wrapper.queryRange(context.Background(), "a", "a", 1593561600, 1593561610, 10)
+	require.NoError(t, err)
+	values := make(map[string][]float64)
+	for _, s := range series {
+		values[s.Name] = s.Values
+	}
+	assert.Equal(t, []float64{1, 2}, values["a.b"])
+	assertValues(t, []float64{3, math.NaN()}, values["a.c"])
+
+	// Without merging the partial results of a single replica are used.
+	config.HA.MergePartial = false
+	series, partial, err := wrapper.queryRange(context.Background(), "a", "a", 1593561600, 1593561610, 10)
+	require.NoError(t, err)
+	assert.NotEmpty(t, series)
+	assert.True(t, partial)
+}
+
+func TestWrapper_fetchSeries_partial(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`{"status":"success","isPartial":true,"data":{"resultType":"matrix","result":[
+			{"metric":{"__a_g1__":"b"},"values":[[100,"1"]]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:     server.URL,
+		PrometheusMaxBody: 1024 * 1024,
+		RenderCache:       RenderCacheConfig{MaxSize: 1024 * 1024},
+	})
+
+	// The partial series aren't cached, so the next request queries them again.
+	for i := 0; i < 2; i++ {
+		series, err := wrapper.fetchSeries(context.Background(), "a", "a", 100, 140, 10)
+		require.NoError(t, err)
+		require.Len(t, series, 1)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestReplicaSet_percentile(t *testing.T) {
+	replicas := newReplicaSet([]string{"http://a"})
+	for i := 0; i < 100; i++ {
+		replicas.observe("/api/v1/label/__a_g1__/values", time.Millisecond)
+		replicas.observe("/api/v1/query_range", time.Second)
+	}
+	// The fast lookups don't shorten the hedge delay of query_range.
+	assert.Equal(t, time.Millisecond, replicas.percentile("/api/v1/label/__b_g2__/values", 0.9))
+	assert.Equal(t, time.Second, replicas.percentile("/api/v1/query_range", 0.9))
+	assert.Equal(t, time.Duration(0), replicas.percentile("/api/v1/series", 0.9))
+}
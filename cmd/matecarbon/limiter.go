@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("too many queued requests")
+	errQueueTimeout = errors.New("queue timeout")
+)
+
+type LimiterConfig struct {
+	// The maximum number of concurrent requests to VictoriaMetrics, 0 means unlimited.
+	MaxConcurrency int `yaml:"max_concurrency"`
+	// The maximum number of concurrent requests to VictoriaMetrics of a single client, 0 means unlimited.
+	MaxClientConcurrency int `yaml:"max_client_concurrency"`
+	// Requests are rejected immediately when there are too many requests waiting, 0 means unlimited.
+	MaxQueueSize int `yaml:"max_queue_size"`
+	// The maximum time that a request waits in the queue, 0 means waiting until the request is canceled.
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// The header that identifies the client, such as X-Grafana-User. The remote address is used by default.
+	ClientHeader string `yaml:"client_header"`
+}
+
+type clientKey struct{}
+
+// withClient stores the client of the incoming request, which is used by the limiter.
+func withClient(ctx context.Context, r *http.Request, header string) context.Context {
+	var client string
+	if header != "" {
+		client = r.Header.Get(header)
+	}
+	if client == "" {
+		client = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+	}
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func clientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// limiter bounds the concurrent requests to VictoriaMetrics globally and per client.
+// So a dashboard with hundreds of targets queues up instead of starving everyone else.
+type limiter struct {
+	config  LimiterConfig
+	global  chan struct{}
+	waiting int32
+
+	lock    sync.Mutex
+	clients map[string]*clientSlots
+}
+
+type clientSlots struct {
+	name  string
+	slots chan struct{}
+	refs  int
+}
+
+func newLimiter(config LimiterConfig) *limiter {
+	l := &limiter{
+		config:  config,
+		clients: make(map[string]*clientSlots),
+	}
+	if config.MaxConcurrency > 0 {
+		l.global = make(chan struct{}, config.MaxConcurrency)
+	}
+	return l
+}
+
+// Acquire waits for a slot of the client in ctx, the returned release must be called after the request is done.
+func (l *limiter) Acquire(ctx context.Context) (release func(), err error) {
+	if l.config.MaxQueueSize > 0 && int(atomic.LoadInt32(&l.waiting)) >= l.config.MaxQueueSize {
+		limiterRejectedQueueFull.Inc()
+		return nil, errQueueFull
+	}
+	atomic.AddInt32(&l.waiting, 1)
+	defer atomic.AddInt32(&l.waiting, -1)
+
+	var timeout <-chan time.Time
+	if l.config.QueueTimeout > 0 {
+		timer := time.NewTimer(l.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	client := l.acquireClient(clientFromContext(ctx))
+	if client != nil {
+		select {
+		case client.slots <- struct{}{}:
+		case <-timeout:
+			l.releaseClient(client, false)
+			limiterRejectedTimeout.Inc()
+			return nil, errQueueTimeout
+		case <-ctx.Done():
+			l.releaseClient(client, false)
+			return nil, ctx.Err()
+		}
+	}
+
+	if l.global != nil {
+		select {
+		case l.global <- struct{}{}:
+		case <-timeout:
+			l.releaseClient(client, true)
+			limiterRejectedTimeout.Inc()
+			return nil, errQueueTimeout
+		case <-ctx.Done():
+			l.releaseClient(client, true)
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() {
+		if l.global != nil {
+			<-l.global
+		}
+		l.releaseClient(client, true)
+	}, nil
+}
+
+func (l *limiter) acquireClient(name string) *clientSlots {
+	if l.config.MaxClientConcurrency <= 0 {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	client, ok := l.clients[name]
+	if !ok {
+		client = &clientSlots{
+			name:  name,
+			slots: make(chan struct{}, l.config.MaxClientConcurrency),
+		}
+		l.clients[name] = client
+	}
+	client.refs++
+	return client
+}
+
+func (l *limiter) releaseClient(client *clientSlots, acquired bool) {
+	if client == nil {
+		return
+	}
+	if acquired {
+		<-client.slots
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	client.refs--
+	if client.refs == 0 {
+		delete(l.clients, client.name)
+	}
+}
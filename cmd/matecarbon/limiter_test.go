@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func clientContext(client string) context.Context {
+	r := httptest.NewRequest("GET", "/render/", nil)
+	r.Header.Set("X-Grafana-User", client)
+	return withClient(context.Background(), r, "X-Grafana-User")
+}
+
+func TestWithClient(t *testing.T) {
+	r := httptest.NewRequest("GET", "/render/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "10.0.0.1", clientFromContext(withClient(context.Background(), r, "")))
+	assert.Equal(t, "10.0.0.1", clientFromContext(withClient(context.Background(), r, "X-Grafana-User")))
+
+	r.Header.Set("X-Grafana-User", "admin")
+	assert.Equal(t, "admin", clientFromContext(withClient(context.Background(), r, "X-Grafana-User")))
+}
+
+func TestLimiter_Client(t *testing.T) {
+	l := newLimiter(LimiterConfig{
+		MaxConcurrency:       2,
+		MaxClientConcurrency: 1,
+		QueueTimeout:         50 * time.Millisecond,
+	})
+
+	release, err := l.Acquire(clientContext("a"))
+	require.NoError(t, err)
+
+	// The client a is waiting for its own slot.
+	_, err = l.Acquire(clientContext("a"))
+	assert.Equal(t, errQueueTimeout, err)
+
+	// Other clients are not affected.
+	releaseB, err := l.Acquire(clientContext("b"))
+	require.NoError(t, err)
+
+	// The global slots are exhausted.
+	_, err = l.Acquire(clientContext("c"))
+	assert.Equal(t, errQueueTimeout, err)
+
+	release()
+	releaseB()
+	release, err = l.Acquire(clientContext("a"))
+	require.NoError(t, err)
+	release()
+	assert.Empty(t, l.clients)
+}
+
+func TestLimiter_QueueFull(t *testing.T) {
+	l := newLimiter(LimiterConfig{
+		MaxConcurrency: 1,
+		MaxQueueSize:   1,
+	})
+
+	release, err := l.Acquire(context.Background())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := l.Acquire(ctx)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = l.Acquire(context.Background())
+	assert.Equal(t, errQueueFull, err)
+	assert.True(t, isRejected(err))
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	release()
+}
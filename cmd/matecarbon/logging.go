@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type LogConfig struct {
+	// text or json, text by default.
+	Format    string          `yaml:"format"`
+	SlowQuery SlowQueryConfig `yaml:"slow_query"`
+}
+
+// SlowQueryConfig logs the find and render targets taking too long to a separate log.
+type SlowQueryConfig struct {
+	// The targets taking longer than this are logged, 0 disables the slow query log.
+	Threshold time.Duration `yaml:"threshold"`
+	// The file of the slow query log in the format above, the standard error by default.
+	Path string `yaml:"path"`
+}
+
+func newFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case "", "text":
+		return &log.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: "2006-01-02 15:04:05",
+		}, nil
+	case "json":
+		return &log.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("log format %q is not one of text and json", format)
+	}
+}
+
+// setupLogging sets the format of the standard logger, and returns the logger of the slow queries.
+func setupLogging(config LogConfig) (*log.Logger, error) {
+	formatter, err := newFormatter(config.Format)
+	if err != nil {
+		return nil, err
+	}
+	log.SetFormatter(formatter)
+
+	slowLog := log.New()
+	slowLog.SetFormatter(formatter)
+	if config.SlowQuery.Path != "" {
+		file, err := os.OpenFile(config.SlowQuery.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		slowLog.SetOutput(file)
+	}
+	return slowLog, nil
+}
+
+// accessLog logs the requests with the request id set by middleware.RequestID.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		startTime := time.Now()
+		defer func() {
+			loggerFrom(r.Context()).WithFields(log.Fields{
+				"type":         "access",
+				"method":       r.Method,
+				"uri":          r.RequestURI,
+				"remote":       r.RemoteAddr,
+				"status":       ww.Status(),
+				"bytes":        ww.BytesWritten(),
+				"took_seconds": time.Since(startTime).Seconds(),
+			}).Info("served")
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
+
+// loggerFrom returns the logger of the request in ctx, which logs the request id and the trace id.
+func loggerFrom(ctx context.Context) *log.Entry {
+	logger := log.NewEntry(log.StandardLogger())
+	if id := middleware.GetReqID(ctx); id != "" {
+		logger = logger.WithField("request_id", id)
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		logger = logger.WithField("trace_id", spanContext.TraceID().String())
+	}
+	return logger
+}
+
+// logDone logs a finished find or render target, and logs it to the slow query log too if it exceeds the threshold.
+func (w *Wrapper) logDone(ctx context.Context, logger *log.Entry, startTime time.Time) {
+	took := time.Since(startTime)
+	logger = logger.WithField("took_seconds", took.Seconds())
+	logger.Info("done")
+
+	threshold := w.configFrom(ctx).Log.SlowQuery.Threshold
+	if threshold > 0 && took >= threshold && w.slowLog != nil {
+		slowQueries.Inc()
+		w.slowLog.WithFields(logger.Data).Warn("slow query")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFormatter(t *testing.T) {
+	formatter, err := newFormatter("")
+	require.NoError(t, err)
+	assert.IsType(t, &log.TextFormatter{}, formatter)
+
+	formatter, err = newFormatter("json")
+	require.NoError(t, err)
+	assert.IsType(t, &log.JSONFormatter{}, formatter)
+
+	_, err = newFormatter("xml")
+	assert.Error(t, err)
+}
+
+func TestAccessLog(t *testing.T) {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	handler := middleware.RequestID(accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loggerFrom(r.Context()).Info("handling")
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("zhi~"))
+	})))
+	r := httptest.NewRequest(http.MethodGet, "/render?target=a.b", nil)
+	r.Header.Set(middleware.RequestIDHeader, "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	entries := hook.AllEntries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "abc", entries[0].Data["request_id"])
+	assert.Equal(t, "abc", entries[1].Data["request_id"])
+	assert.Equal(t, "access", entries[1].Data["type"])
+	assert.Equal(t, "/render?target=a.b", entries[1].Data["uri"])
+	assert.Equal(t, http.StatusTeapot, entries[1].Data["status"])
+	assert.Equal(t, 4, entries[1].Data["bytes"])
+}
+
+func TestWrapper_logDone(t *testing.T) {
+	slowLog, hook := test.NewNullLogger()
+	config := &Config{}
+	wrapper := newWrapper(config)
+	wrapper.slowLog = slowLog
+
+	logger := log.WithField("path", "a.b")
+	wrapper.logDone(context.Background(), logger, time.Now().Add(-time.Second))
+	assert.Empty(t, hook.AllEntries())
+
+	config.Log.SlowQuery.Threshold = time.Minute
+	wrapper.logDone(context.Background(), logger, time.Now().Add(-time.Second))
+	assert.Empty(t, hook.AllEntries())
+
+	config.Log.SlowQuery.Threshold = 500 * time.Millisecond
+	wrapper.logDone(context.Background(), logger, time.Now().Add(-time.Second))
+	require.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	assert.Equal(t, "slow query", entry.Message)
+	assert.Equal(t, "a.b", entry.Data["path"])
+	assert.GreaterOrEqual(t, entry.Data["took_seconds"], 1.0)
+}
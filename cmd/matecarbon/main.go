@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,10 +10,15 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
@@ -20,26 +26,73 @@ import (
 	jsoniter "github.com/json-iterator/go"
 	log "github.com/sirupsen/logrus"
 	"github.com/zhihu/promate/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 	"gopkg.in/yaml.v3"
 )
 
 var defaultMaxDatapoints float64 = 1024
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
+// shutdownTimeout bounds draining the requests and flushing the spans on SIGINT or SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
+var decoderPool = &sync.Pool{
+	New: func() interface{} {
+		return prometheus.NewMatrixDecoder(nil)
+	},
+}
+
 type RollupConfig struct {
 	MatchSuffix   string         `yaml:"match_suffix"`
 	MatchSuffixRe *regexp.Regexp `yaml:"-"`
 	RollupFunc    string         `yaml:"rollup_func"`
+	// The minimum fraction of non-null samples in a step, see RollupRule.
+	XFilesFactor float64 `yaml:"x_files_factor"`
+}
+
+type RenderCacheConfig struct {
+	MaxSize   int64         `yaml:"max_size"`
+	Freshness time.Duration `yaml:"freshness"`
+}
+
+type FindCacheConfig struct {
+	Size       int           `yaml:"size"`
+	TTL        time.Duration `yaml:"ttl"`
+	TimeBucket time.Duration `yaml:"time_bucket"`
 }
 
 type Config struct {
-	Listen              string          `yaml:"listen"`
-	LogLevel            log.Level       `yaml:"-"`
-	StatsdFlushInterval float64         `yaml:"statsd_flush_interval"`
-	PrometheusURL       string          `yaml:"prometheus_url"`
-	PrometheusMaxBody   int64           `yaml:"prometheus_max_body"`
-	Rollups             []*RollupConfig `yaml:"rollups"`
-	DefaultRollupFunc   string          `yaml:"default_rollup_func"`
+	Listen              string                    `yaml:"listen"`
+	LogLevel            log.Level                 `yaml:"-"`
+	StatsdFlushInterval float64                   `yaml:"statsd_flush_interval"`
+	Resolutions         []*ResolutionRule         `yaml:"resolutions"`
+	ResolutionDiscovery ResolutionDiscoveryConfig `yaml:"resolution_discovery"`
+	PrometheusURL       string                    `yaml:"prometheus_url"`
+	// The equivalent replicas of prometheus_url.
+	PrometheusReplicas []string `yaml:"prometheus_replicas"`
+	// The first segments of the paths stored in prometheus_url, which a glob first segment is expanded to like the roots of the backends.
+	// Otherwise a glob first segment is only sent to prometheus_url when it matches none of the roots of the backends.
+	PrometheusRoots     []string          `yaml:"prometheus_roots"`
+	PrometheusMaxBody   int64             `yaml:"prometheus_max_body"`
+	RollupRules         []*RollupRule     `yaml:"rollup_rules"`
+	Rollups             []*RollupConfig   `yaml:"rollups"`
+	DefaultRollupFunc   string            `yaml:"default_rollup_func"`
+	DefaultXFilesFactor float64           `yaml:"default_x_files_factor"`
+	RenderCache         RenderCacheConfig `yaml:"render_cache"`
+	FindCache           FindCacheConfig   `yaml:"find_cache"`
+	Find                FindConfig        `yaml:"find"`
+	Limiter             LimiterConfig     `yaml:"limiter"`
+	Expand              ExpandConfig      `yaml:"expand"`
+	Guardrails          GuardrailsConfig  `yaml:"guardrails"`
+	Backends            []*BackendConfig  `yaml:"backends"`
+	HA                  HAConfig          `yaml:"ha"`
+	Timeout             TimeoutConfig     `yaml:"timeout"`
+	RenderBatch         RenderBatchConfig `yaml:"render_batch"`
+	Log                 LogConfig         `yaml:"log"`
+	Tracing             TracingConfig     `yaml:"tracing"`
 }
 
 func LoadConfig(configPath string) (*Config, error) {
@@ -57,13 +110,47 @@ func LoadConfig(configPath string) (*Config, error) {
 		if err != nil {
 			return nil, err
 		}
+		if rollup.XFilesFactor < 0 || rollup.XFilesFactor > 1 {
+			return nil, fmt.Errorf("rollup %s: x_files_factor must be between 0 and 1", rollup.MatchSuffix)
+		}
+	}
+	if config.StatsdFlushInterval <= 0 {
+		return nil, errors.New("statsd_flush_interval must be greater than 0")
+	}
+	if config.DefaultXFilesFactor < 0 || config.DefaultXFilesFactor > 1 {
+		return nil, errors.New("default_x_files_factor must be between 0 and 1")
+	}
+	if err = compileRollupRules(config.RollupRules); err != nil {
+		return nil, err
+	}
+	if err = compileResolutionRules(config.Resolutions); err != nil {
+		return nil, err
+	}
+	if err = compileGuardrails(&config.Guardrails); err != nil {
+		return nil, err
+	}
+	if err = compileBackends(config.Backends); err != nil {
+		return nil, err
+	}
+	for _, root := range config.PrometheusRoots {
+		if !isLiteralRoot(root) {
+			return nil, fmt.Errorf("prometheus root %q must be a single literal segment", root)
+		}
+	}
+	if err = config.Find.validate(); err != nil {
+		return nil, err
+	}
+	if _, err = newFormatter(config.Log.Format); err != nil {
+		return nil, err
 	}
 	return config, err
 }
 
 func main() {
 	var configPath string
+	var reloadInterval time.Duration
 	flag.StringVar(&configPath, "c", "matecarbon.yaml", "config file path")
+	flag.DurationVar(&reloadInterval, "reload-interval", 0, "reload the config file when it's modified, checked at this interval. 0 means only reloading on SIGHUP")
 	flag.Parse()
 
 	config, err := LoadConfig(configPath)
@@ -71,18 +158,28 @@ func main() {
 		log.Fatal(err)
 	}
 
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp:   true,
-		TimestampFormat: "2006-01-02 15:04:05",
-	})
+	slowLog, err := setupLogging(config.Log)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tracerProvider, err := setupTracing(config.Tracing)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	wrapper := newWrapper(config)
+	wrapper.slowLog = slowLog
+	go watchConfig(wrapper, configPath, reloadInterval)
 
 	router := chi.NewRouter()
 
 	router.Use(middleware.Recoverer)
-	router.Use(middleware.Logger)
 	router.Use(middleware.RealIP)
+	router.Use(traceHandler)
+	// The request id is taken from the X-Request-Id header of carbonapi if it's set.
+	router.Use(middleware.RequestID)
+	router.Use(accessLog)
 
 	router.Get("/check_health", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("zhi~"))
@@ -90,69 +187,62 @@ func main() {
 
 	router.Mount("/debug", middleware.Profiler())
 
-	router.Get("/metrics/find/", func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		multiRequest := &protov3.MultiGlobRequest{}
-		err = multiRequest.Unmarshal(body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	router.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metrics.WritePrometheus(w, true)
+	})
 
-		multiResponse, err := wrapper.Find(r.Context(), multiRequest)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	// The APIs querying VictoriaMetrics are bounded by the request deadline, the profiler and the metrics aren't.
+	router.Group(func(router chi.Router) {
+		router.Use(requestContext(wrapper))
 
-		blob, err := multiResponse.Marshal()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/x-protobuf")
-		_, _ = w.Write(blob)
-	})
+		router.Get("/metrics/find/", findHandler(wrapper))
+		router.Post("/metrics/find/", findHandler(wrapper))
+		router.Get("/render/", renderHandler(wrapper))
+		router.Post("/render/", renderHandler(wrapper))
 
-	router.Get("/render/", func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		multiRequest := &protov3.MultiFetchRequest{}
-		err = multiRequest.Unmarshal(body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+		router.Get("/metrics/find", graphiteFind(wrapper))
+		router.Post("/metrics/find", graphiteFind(wrapper))
+		router.Get("/render", graphiteRender(wrapper))
+		router.Post("/render", graphiteRender(wrapper))
 
-		multiResponse, err := wrapper.Render(r.Context(), multiRequest)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		router.Get("/metrics/expand", expandHandler(wrapper))
+		router.Get("/metrics/index.json", indexHandler(wrapper))
 
-		blob, err := multiResponse.Marshal()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/x-protobuf")
-		_, _ = w.Write(blob)
+		router.Get("/tags", tagsHandler(wrapper))
+		router.Get("/tags/autoComplete/tags", autoCompleteTagsHandler(wrapper))
+		router.Get("/tags/autoComplete/values", autoCompleteValuesHandler(wrapper))
 	})
 
-	log.Fatal(http.ListenAndServe(config.Listen, router))
+	server := &http.Server{Addr: config.Listen, Handler: router}
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("shutdown the server failed %s", err)
+		}
+	}()
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// The spans of the last requests are still batched.
+	if tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			log.Warnf("shutdown tracing failed %s", err)
+		}
+	}
 }
 
 func newWrapper(config *Config) *Wrapper {
 	request := req.New()
 	request.SetClient(&http.Client{
-		Transport: &http.Transport{
+		// The client spans propagate the trace context to VictoriaMetrics.
+		Transport: otelhttp.NewTransport(&http.Transport{
 			DialContext: (&net.Dialer{
 				Timeout:   1 * time.Second,
 				KeepAlive: 1 * time.Second,
@@ -162,25 +252,96 @@ func newWrapper(config *Config) *Wrapper {
 			IdleConnTimeout:       30 * time.Second,
 			TLSHandshakeTimeout:   1 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
-		},
+		}),
 		// Don't worry about the request taking too long.
-		// It will end when the user's request context cancel or VictoriaMetrics timeout.
+		// It will end when the user's request context cancel or its deadline passes, see TimeoutConfig.
 		Timeout: time.Minute * 10,
 	})
-	return &Wrapper{
-		config:  config,
+	wrapper := &Wrapper{
 		request: request,
+		limiter: newLimiter(config.Limiter),
+	}
+	wrapper.config.Store(config)
+	if config.RenderCache.MaxSize > 0 {
+		wrapper.renderCache = newRenderCache(config.RenderCache.MaxSize)
+	}
+	if config.FindCache.Size > 0 {
+		wrapper.findCache = newLRUCache[[]protov3.GlobMatch](config.FindCache.Size, config.FindCache.TTL)
+	}
+	if config.ResolutionDiscovery.Enabled {
+		size, ttl := config.ResolutionDiscovery.Size, config.ResolutionDiscovery.TTL
+		if size <= 0 {
+			size = 10000
+		}
+		if ttl <= 0 {
+			ttl = 10 * time.Minute
+		}
+		wrapper.resolutionCache = newLRUCache[float64](size, ttl)
 	}
+	return wrapper
 }
 
 type Wrapper struct {
-	config  *Config
-	request *req.Req
+	// The *Config, which is swapped when the config file is reloaded.
+	config      atomic.Value
+	request     *req.Req
+	renderCache *renderCache
+	findCache   *lruCache[[]protov3.GlobMatch]
+	findGroup   singleflight.Group
+	limiter     *limiter
+
+	// The discovered resolutions, 0 means falling back to the statsd flush interval.
+	resolutionCache *lruCache[float64]
+	resolutionGroup singleflight.Group
+	// The logger of the slow queries, they aren't logged when it's nil.
+	slowLog *log.Logger
+
+	replicaLock sync.Mutex
+	replicaSets map[string]*replicaSet
+}
+
+// Config returns the current config, it must not be modified.
+func (w *Wrapper) Config() *Config {
+	return w.config.Load().(*Config)
+}
+
+type configKey struct{}
+
+// withConfig pins the config of the request in ctx, so a reload in the middle of the request doesn't mix two configs.
+func withConfig(ctx context.Context, config *Config) context.Context {
+	return context.WithValue(ctx, configKey{}, config)
+}
+
+// configFrom returns the config pinned in ctx, or the current config.
+func (w *Wrapper) configFrom(ctx context.Context) *Config {
+	if config, ok := ctx.Value(configKey{}).(*Config); ok {
+		return config
+	}
+	return w.Config()
 }
 
 func (w *Wrapper) Find(ctx context.Context, multiRequest *protov3.MultiGlobRequest) (multiResponse *protov3.MultiGlobResponse, err error) {
 	var wg sync.WaitGroup
 	var lock sync.Mutex
+	var failed error
+
+	requestTime := time.Now()
+	defer func() { observeRequest("find", requestTime, err) }()
+	findTargetsTotal.Add(len(multiRequest.Metrics))
+
+	// The config is pinned for the whole request, see withConfig.
+	config := w.configFrom(ctx)
+	ctx = withConfig(ctx, config)
+
+	// The remaining targets are aborted once the request fails, as the response would be dropped anyway.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fail := func(err error) {
+		lock.Lock()
+		failed = err
+		lock.Unlock()
+		cancel()
+	}
 
 	multiResponse = &protov3.MultiGlobResponse{
 		Metrics: make([]protov3.GlobResponse, 0),
@@ -189,7 +350,8 @@ func (w *Wrapper) Find(ctx context.Context, multiRequest *protov3.MultiGlobReque
 	for _, target := range multiRequest.Metrics {
 		wg.Add(1)
 		go func(target string) {
-			logger := log.WithFields(log.Fields{
+			ctx, span := tracer().Start(ctx, "find target", trace.WithAttributes(attribute.String("graphite.path", target)))
+			logger := loggerFrom(ctx).WithFields(log.Fields{
 				"type": "find",
 				"path": target,
 			})
@@ -198,13 +360,15 @@ func (w *Wrapper) Find(ctx context.Context, multiRequest *protov3.MultiGlobReque
 			defer func() {
 				wg.Done()
 
-				logger.Infof("took %s", time.Since(startTime))
+				span.End()
+				w.logDone(ctx, logger, startTime)
 			}()
 
 			// We can't query the full amount of metrics, which can cause serious performance issues.
 			// https://github.com/VictoriaMetrics/VictoriaMetrics/issues/329#issuecomment-590773944
 			if target == "*" {
 				logger.Warnf("can't query full amount metrics")
+				rootQueriesBlocked.Inc()
 				return
 			}
 
@@ -214,57 +378,40 @@ func (w *Wrapper) Find(ctx context.Context, multiRequest *protov3.MultiGlobReque
 			// Now the carbonapi_v3_pb protocol doesn't return custom errors, so it's ignored here.
 			if len(target) > 8192 {
 				logger.Errorf("path too long")
+				findLongPaths.Inc()
 				return
 			}
 
-			var params req.Param
-
-			name, filters := prometheus.ConvertGraphiteTarget(target, false)
-			selector := filters.Build(name)
-
-			prefix, query, fast := prometheus.ConvertQueryLabel(target)
-			// In VictoriaMetrics, query is faster without query params.
-			// We can use this approach for the second segment of our graphite metrics.
-			// https://github.com/VictoriaMetrics/VictoriaMetrics/issues/359#issuecomment-596098714
-			if !fast {
-				params = req.Param{
-					"start":   multiRequest.StartTime,
-					"end":     multiRequest.StopTime,
-					"match[]": selector,
-				}
-			}
-
-			resp, err := w.request.Get(fmt.Sprintf("%s/api/v1/label/%s/values", w.config.PrometheusURL, query), ctx, params)
-			if err != nil {
-				logger.Errorf("request failed %s", err)
+			if _, err := config.Guardrails.guardrailOf(target); err != nil {
+				logger.Warnf("blocked by guardrails %s", err)
+				countError(errorKind(err))
+				recordError(span, err)
+				fail(err)
 				return
 			}
 
-			defer func() { _ = resp.Response().Body.Close() }()
-
-			// We restrict particularly large responses to queries that can use MateQL.
-			body, err := ioutil.ReadAll(io.LimitReader(resp.Response().Body, w.config.PrometheusMaxBody))
+			matches, truncated, err := w.findRoutes(ctx, target, multiRequest.StartTime, multiRequest.StopTime)
 			if err != nil {
-				logger.Errorf("read response failed %s", err)
+				logger.Errorf("find failed %s", err)
+				countError(errorKind(err))
+				recordError(span, err)
+				if isRejected(err) {
+					fail(err)
+				}
 				return
 			}
 
-			data := new(prometheus.ValuesResponse)
-			err = json.Unmarshal(body, data)
-			if err != nil {
-				logger.Errorf("unmarshal %s failed %s", string(body), err)
-				return
+			findMatchesTotal.Add(len(matches))
+			logger = logger.WithField("matches", len(matches))
+			span.SetAttributes(attribute.Int("graphite.matches", len(matches)), attribute.Bool("graphite.truncated", truncated))
+			// The carbonapi_v3_pb protocol can't tell that the matches are incomplete, so it's only logged.
+			if truncated {
+				logger = logger.WithField("truncated", true)
+				logger.Warnf("matches truncated, please narrow it down")
 			}
-
 			metric := protov3.GlobResponse{
 				Name:    target,
-				Matches: make([]protov3.GlobMatch, 0, len(data.Data)),
-			}
-			for _, label := range data.Data {
-				metric.Matches = append(metric.Matches, protov3.GlobMatch{
-					IsLeaf: false,
-					Path:   prefix + label,
-				})
+				Matches: matches,
 			}
 
 			lock.Lock()
@@ -274,184 +421,651 @@ func (w *Wrapper) Find(ctx context.Context, multiRequest *protov3.MultiGlobReque
 	}
 
 	wg.Wait()
+	// A partial response is misleading, so the whole request fails when any target is shed by the limiter or blocked by the guardrails,
+	// or the deadline passes before all targets are done.
+	if failed == nil {
+		failed = deadlineError(ctx)
+	}
+	if failed != nil {
+		return nil, failed
+	}
 	return multiResponse, nil
 }
 
+// findRoutes returns the matches of target in the backends serving it, the matches of several backends are merged.
+// It reports whether the matches of any backend are truncated.
+func (w *Wrapper) findRoutes(ctx context.Context, target string, start, stop int64) ([]protov3.GlobMatch, bool, error) {
+	routes := w.configFrom(ctx).routesOf(target)
+	if len(routes) == 1 {
+		return w.findMatches(withBackend(ctx, routes[0].url), routes[0].target, start, stop)
+	}
+
+	seen := make(map[string]bool)
+	merged := make([]protov3.GlobMatch, 0)
+	truncated := false
+	for _, route := range routes {
+		matches, t, err := w.findMatches(withBackend(ctx, route.url), route.target, start, stop)
+		if err != nil {
+			return nil, false, err
+		}
+		truncated = truncated || t
+		for _, match := range matches {
+			if !seen[match.Path] {
+				seen[match.Path] = true
+				merged = append(merged, match)
+			}
+		}
+	}
+	return merged, truncated, nil
+}
+
+// findMatches returns the matches of target, from the find cache if it's enabled, and reports whether they are truncated.
+// Concurrent lookups of the same target and time bucket share a single request to VictoriaMetrics.
+func (w *Wrapper) findMatches(ctx context.Context, target string, start, stop int64) ([]protov3.GlobMatch, bool, error) {
+	if w.findCache == nil {
+		lookup, err := w.lookupMatches(ctx, target, start, stop)
+		return lookup.matches, lookup.truncated, err
+	}
+
+	config := w.configFrom(ctx)
+	bucket := int64(config.FindCache.TimeBucket.Seconds())
+	if bucket <= 0 {
+		bucket = 1
+	}
+	key := fmt.Sprintf("%s@%d-%d@%s", target, start/bucket, stop/bucket, w.backendURL(ctx))
+
+	findCacheRequests.Inc()
+	if matches, ok := w.findCache.Get(key); ok {
+		findCacheHits.Inc()
+		return matches, false, nil
+	}
+
+	results := w.findGroup.DoChan(key, func() (interface{}, error) {
+		// The lookup is shared by the concurrent requests, so it isn't canceled with the request starting it.
+		ctx, cancel := sharedDeadline(ctx, config.Timeout)
+		defer cancel()
+		lookup, err := w.lookupMatches(ctx, target, start, stop)
+		if err != nil {
+			return nil, err
+		}
+		// The missing matches of an incomplete lookup would be hidden until the entry expires.
+		if !lookup.partial && !lookup.truncated {
+			w.findCache.Set(key, lookup.matches)
+		}
+		return lookup, nil
+	})
+	select {
+	case result := <-results:
+		if result.Shared {
+			findCacheShared.Inc()
+		}
+		if result.Err != nil {
+			return nil, false, result.Err
+		}
+		lookup := result.Val.(findLookup)
+		return lookup.matches, lookup.truncated, nil
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// lookupMatches queries the next segment values of target from VictoriaMetrics.
+func (w *Wrapper) lookupMatches(ctx context.Context, target string, start, stop int64) (findLookup, error) {
+	if w.configFrom(ctx).Find.strategyOf(target) == findStrategySeries {
+		findSeriesLookups.Inc()
+		return w.lookupSeriesMatches(ctx, target, start, stop)
+	}
+	findLabelValuesLookups.Inc()
+
+	var params req.Param
+
+	name, filters := prometheus.ConvertGraphiteTarget(target, false)
+	selector := filters.Build(name)
+
+	prefix, query, fast := prometheus.ConvertQueryLabel(target)
+	// In VictoriaMetrics, query is faster without query params.
+	// We can use this approach for the second segment of our graphite metrics.
+	// https://github.com/VictoriaMetrics/VictoriaMetrics/issues/359#issuecomment-596098714
+	if !fast {
+		params = req.Param{
+			"start":   start,
+			"end":     stop,
+			"match[]": selector,
+		}
+	}
+
+	values, partial, err := w.getValues(ctx, fmt.Sprintf("/api/v1/label/%s/values", query), params)
+	if err != nil {
+		return findLookup{}, err
+	}
+
+	matches := make([]protov3.GlobMatch, 0, len(values))
+	for _, label := range values {
+		matches = append(matches, protov3.GlobMatch{
+			IsLeaf: false,
+			Path:   prefix + label,
+		})
+	}
+	return findLookup{matches: matches, partial: partial}, nil
+}
+
+// convertTarget converts the path or seriesByTag expression of the render request to the name and label filters.
+func convertTarget(target string) (string, prometheus.LabelFilters, error) {
+	if prometheus.IsSeriesByTag(target) {
+		return prometheus.ConvertSeriesByTag(target)
+	}
+	name, filters := prometheus.ConvertGraphiteTarget(target, true)
+	return name, filters, nil
+}
+
+// getValues requests the VictoriaMetrics APIs which respond a list of strings, such as labels and label values.
+// It reports whether the values are partial too.
+func (w *Wrapper) getValues(ctx context.Context, path string, params req.Param) ([]string, bool, error) {
+	release, err := w.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	partial, err := w.get(ctx, path, params, func(body io.Reader) (bool, error) {
+		// We restrict particularly large responses to queries that can use MateQL.
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return false, fmt.Errorf("read response failed %w", err)
+		}
+		if path == "/api/v1/labels" {
+			observeResponseSize("labels", int64(len(data)))
+		} else {
+			observeResponseSize("label_values", int64(len(data)))
+		}
+
+		resp := new(prometheus.ValuesResponse)
+		err = json.Unmarshal(data, resp)
+		if err != nil {
+			return false, fmt.Errorf("unmarshal %s failed %w", string(data), err)
+		}
+		if resp.Status == "error" {
+			return false, fmt.Errorf("%s: %s", resp.ErrorType, resp.Error)
+		}
+		for _, value := range resp.Data {
+			if !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+		}
+		return resp.IsPartial, nil
+	})
+	return values, partial, err
+}
+
 func (w *Wrapper) Render(ctx context.Context, multiRequest *protov3.MultiFetchRequest) (multiResponse *protov3.MultiFetchResponse, err error) {
 	var wg sync.WaitGroup
 	var locker sync.Mutex
+	var failed error
+	// The targets merged into batch queries after all targets are planned,
+	// the other targets are fetched as soon as they are planned.
+	var planning sync.WaitGroup
+	var batched []*renderPlan
+
+	requestTime := time.Now()
+	defer func() { observeRequest("render", requestTime, err) }()
+	renderTargetsTotal.Add(len(multiRequest.Metrics))
+
+	// The routes, rollups and batches of the request are decided by the same config.
+	config := w.configFrom(ctx)
+	ctx = withConfig(ctx, config)
+
+	// For the same reasons as Find.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fail := func(err error) {
+		locker.Lock()
+		failed = err
+		locker.Unlock()
+		cancel()
+	}
 
 	multiResponse = &protov3.MultiFetchResponse{
 		Metrics: make([]protov3.FetchResponse, 0),
 	}
+	respond := func(plan *renderPlan, series []*renderSeries) {
+		renderSeriesTotal.Add(len(series))
+		renderPointsTotal.Add(len(series) * int((plan.end-plan.start)/plan.step+1))
+		for _, s := range series {
+			// ConsolidationFunc is the consolidation strategy chosen by carbonapi to avoid exceeding MaxDataPoints in response to data.
+			// It can be modified by the function consolidateBy. https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.consolidateBy
+			// But now the query step is dynamic and response points must not exceed MaxDataPoints, so this configuration or function becomes unnecessary.
+			consolidationFunc := "avg"
+
+			// The points of a timeShift are queried in the original range, they are responded in the requested one.
+			metric := protov3.FetchResponse{
+				Name:              s.Name,
+				PathExpression:    plan.request.PathExpression,
+				RequestStartTime:  plan.request.StartTime,
+				RequestStopTime:   plan.request.StopTime,
+				ConsolidationFunc: consolidationFunc,
+				StartTime:         plan.start - plan.offset,
+				StopTime:          plan.end - plan.offset,
+				StepTime:          plan.step,
+				Values:            plan.rollup.fill(s.Values),
+			}
+
+			locker.Lock()
+			multiResponse.Metrics = append(multiResponse.Metrics, metric)
+			locker.Unlock()
+		}
+	}
+
 	for _, request := range multiRequest.Metrics {
+		// A target whose first segment is a glob may span several backends, they are queried separately.
+		for _, route := range config.routesOf(request.PathExpression) {
+			wg.Add(1)
+			planning.Add(1)
+			go func(request protov3.FetchRequest, route backendRoute) {
+				planned := sync.OnceFunc(planning.Done)
+				ctx := withBackend(ctx, route.url)
+				target := route.target
+				ctx, span := tracer().Start(ctx, "render target", trace.WithAttributes(
+					attribute.String("graphite.path", target),
+					attribute.String("matecarbon.backend", route.url),
+				))
+				logger := loggerFrom(ctx).WithFields(log.Fields{
+					"type":            "render",
+					"start":           request.StartTime,
+					"end":             request.StopTime,
+					"path":            target,
+					"max_data_points": request.MaxDataPoints,
+				})
+
+				startTime := time.Now()
+				defer func() {
+					planned()
+					wg.Done()
+
+					span.End()
+					w.logDone(ctx, logger, startTime)
+				}()
+
+				// For the same reasons as above.
+				if len(request.PathExpression) > 8192 {
+					logger.Errorf("path too long")
+					renderLongPaths.Inc()
+					return
+				}
+
+				block := func(err error) {
+					logger.Warnf("blocked by guardrails %s", err)
+					countError(errorKind(err))
+					recordError(span, err)
+					if isRejected(err) || isQueryError(err) {
+						fail(err)
+					}
+				}
+
+				// The histogram rollups query the buckets rather than the target.
+				rollup := config.rollupOf(target, request.StartTime, time.Now())
+				source := rollup.Source(target)
+
+				// The time range of a timeShift is shifted back to the original one, and the query looks back with an offset.
+				shift, err := timeShiftOf(request)
+				if err != nil {
+					logger.Warnf("ignore the time shift hint %s", err)
+					shift = 0
+				}
+				offset := -int64(shift / time.Second)
+				start, stop := request.StartTime+offset, request.StopTime+offset
+
+				// The denied targets and time ranges are blocked before querying anything.
+				guardrail, err := config.Guardrails.checkTarget(source, start, stop)
+				if err != nil {
+					block(err)
+					return
+				}
+
+				name, filters, err := convertTarget(source)
+				if err != nil {
+					logger.Errorf("convert target failed %s", err)
+					countError("convert")
+					recordError(span, err)
+					return
+				}
+				selector := filters.Build(name)
+
+				// The default value is used when the request does not take the MaxDataPoints.
+				// Most of these requests come from scripts, not Grafana.
+				maxDataPoints := float64(request.MaxDataPoints)
+				if maxDataPoints == 0 {
+					maxDataPoints = defaultMaxDatapoints
+				}
+
+				timeRange := float64(stop - start)
+				// The step is a multiple of the resolution, so each point covers the same number of samples.
+				interval := w.resolutionOf(ctx, source, selector)
+				step := rollup.Step(timeRange, maxDataPoints, interval)
+				query := rollup.Query(target, selector, step, interval, offset)
+
+				// VictoriaMetrics aligns the points to multiples of step, we do the same so that the series can be cached and reused.
+				// The start and end points are aligned with the time of the request, otherwise the division calculation in carbonapi will fail.
+				metricStep := int64(step)
+				metricStart := (start + metricStep - 1) / metricStep * metricStep
+				metricEnd := stop / metricStep * metricStep
+				if metricEnd < metricStart {
+					logger.Warnf("time range shorter than step %d", metricStep)
+					return
+				}
+
+				// The guardrails check the series in the time range where the samples are.
+				if err := w.checkRender(ctx, guardrail, source, selector, metricStart-offset, metricEnd-offset, metricStep); err != nil {
+					block(err)
+					return
+				}
+
+				plan := &renderPlan{
+					request:  request,
+					url:      route.url,
+					target:   target,
+					name:     name,
+					filters:  filters,
+					query:    query,
+					rollup:   rollup,
+					interval: interval,
+					start:    metricStart,
+					end:      metricEnd,
+					step:     metricStep,
+					offset:   offset,
+				}
+				logger = logger.WithFields(log.Fields{
+					"backend": route.url,
+					"query":   query,
+					"step":    metricStep,
+					"offset":  offset,
+				})
+				span.SetAttributes(attribute.String("metricsql.query", query), attribute.Int64("metricsql.step", metricStep))
+				if config.RenderBatch.batchable(plan) {
+					// The series are logged with the batch.
+					logger = logger.WithField("batched", true)
+					locker.Lock()
+					batched = append(batched, plan)
+					locker.Unlock()
+					return
+				}
+
+				planned()
+				fetchTime := time.Now()
+				var series []*renderSeries
+				if rollup.cacheable() {
+					series, err = w.fetchSeries(ctx, name, query, metricStart, metricEnd, metricStep)
+				} else {
+					series, _, err = w.queryRange(ctx, name, query, metricStart, metricEnd, metricStep)
+				}
+				logger = logger.WithField("backend_seconds", time.Since(fetchTime).Seconds())
+				if err != nil {
+					logger.Errorf("fetch failed %s", err)
+					countError(errorKind(err))
+					recordError(span, err)
+					if isRejected(err) {
+						fail(err)
+					}
+					return
+				}
+				logger = logger.WithFields(log.Fields{
+					"series": len(series),
+					"points": len(series) * int((metricEnd-metricStart)/metricStep+1),
+				})
+				span.SetAttributes(attribute.Int("graphite.series", len(series)))
+				respond(plan, series)
+			}(request, route)
+		}
+	}
+	planning.Wait()
+
+	for _, batch := range config.RenderBatch.group(batched) {
 		wg.Add(1)
-		go func(request protov3.FetchRequest) {
-			logger := log.WithFields(log.Fields{
-				"type":            "render",
-				"start":           request.StartTime,
-				"end":             request.StopTime,
-				"path":            request.PathExpression,
-				"max_data_points": request.MaxDataPoints,
+		go func(batch []*renderPlan) {
+			ctx := withBackend(ctx, batch[0].url)
+			ctx, span := tracer().Start(ctx, "render batch", trace.WithAttributes(
+				attribute.StringSlice("graphite.paths", batchPaths(batch)),
+				attribute.String("matecarbon.backend", batch[0].url),
+				attribute.Int64("metricsql.step", batch[0].step),
+			))
+			logger := loggerFrom(ctx).WithFields(log.Fields{
+				"type":    "render_batch",
+				"start":   batch[0].request.StartTime,
+				"end":     batch[0].request.StopTime,
+				"name":    batch[0].name,
+				"targets": len(batch),
+				"backend": batch[0].url,
+				"step":    batch[0].step,
+				"paths":   batchPaths(batch),
 			})
 
 			startTime := time.Now()
 			defer func() {
 				wg.Done()
 
-				logger.Infof("took %s", time.Since(startTime))
+				span.End()
+				w.logDone(ctx, logger, startTime)
 			}()
 
-			// For the same reasons as above.
-			if len(request.PathExpression) > 8192 {
-				logger.Errorf("path too long")
+			results, err := w.fetchBatch(ctx, batch)
+			logger = logger.WithField("backend_seconds", time.Since(startTime).Seconds())
+			if err != nil {
+				logger.Errorf("fetch failed %s", err)
+				recordError(span, err)
+				for range batch {
+					countError(errorKind(err))
+				}
+				if isRejected(err) {
+					fail(err)
+				}
 				return
 			}
+			series := 0
+			for i, plan := range batch {
+				series += len(results[i])
+				respond(plan, results[i])
+			}
+			logger = logger.WithFields(log.Fields{
+				"series": series,
+				"points": series * int((batch[0].end-batch[0].start)/batch[0].step+1),
+			})
+		}(batch)
+	}
+	wg.Wait()
 
-			name, filters := prometheus.ConvertGraphiteTarget(request.PathExpression, true)
-			selector := filters.Build(name)
+	if failed == nil {
+		failed = deadlineError(ctx)
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	return multiResponse, nil
+}
 
-			// The default value is used when the request does not take the MaxDataPoints.
-			// Most of these requests come from scripts, not Grafana.
-			maxDataPoints := float64(request.MaxDataPoints)
-			if maxDataPoints == 0 {
-				maxDataPoints = defaultMaxDatapoints
-			}
-			timeRange := float64(request.StopTime - request.StartTime)
-			// Try to set step to a multiple of the statsd flush interval.
-			// Otherwise the returned result will be jittery.
-			multipleInterval := math.Ceil(timeRange/maxDataPoints/w.config.StatsdFlushInterval) * w.config.StatsdFlushInterval
-			step := math.Max(multipleInterval, w.config.StatsdFlushInterval)
-			window := fmt.Sprintf("%ds", int(step))
-
-			// Similar to carbon's storage aggregation strategy, but in real time. https://graphite.readthedocs.io/en/latest/config-carbon.html#storage-aggregation-conf
-			// Here the aggregation strategy is chosen based on queries rather than stored metrics.
-			// So there is no way to configure it based on the full metrics name, only the suffix.
-			// In future the aggregation strategy needs to be determined based on the incoming consolidateBy function, not just the pre-configuration file.
-			// Which would require the carbonapi_v3_pb protocol to pass the aggregation strategy.
-			var query string
-			for _, rollup := range w.config.Rollups {
-				if rollup.MatchSuffixRe.MatchString(request.PathExpression) {
-					query = fmt.Sprintf(`%s(%s[%ds])`, rollup.RollupFunc, selector, int(step))
-					break
-				}
-			}
-			if query == "" {
-				query = fmt.Sprintf(`%s(%s[%ds])`, w.config.DefaultRollupFunc, selector, int(step))
-			}
+// renderSeries is a series whose values are aligned to the step grid of the query, the missing points are NaN.
+type renderSeries struct {
+	Name   string
+	Values []float64
+}
 
-			// In graphite, we do the downscaling in step window size
-			// This is different in VictoriaMetrics, so we need to specify the window size for the calculation with max_lookback.
-			// https://github.com/VictoriaMetrics/VictoriaMetrics/issues/549#issuecomment-653643283
-			params := req.Param{
-				"query":        query,
-				"start":        request.StartTime,
-				"end":          request.StopTime,
-				"step":         window,
-				"max_lookback": window,
-			}
+// fetchSeries returns the series of query in the [start, end] range.
+// When the render cache is enabled, only the part of the range not in the cache is queried from VictoriaMetrics.
+func (w *Wrapper) fetchSeries(ctx context.Context, name, query string, start, end, step int64) ([]*renderSeries, error) {
+	if w.renderCache == nil {
+		series, _, err := w.queryRange(ctx, name, query, start, end, step)
+		return series, err
+	}
 
-			resp, err := w.request.Get(fmt.Sprintf("%s/api/v1/query_range", w.config.PrometheusURL), ctx, params)
-			if err != nil {
-				logger.Errorf("request failed %s", err)
-				return
+	key := fmt.Sprintf("%s@%d@%s", query, step, w.backendURL(ctx))
+	series, cachedEnd := w.renderCache.Get(key, start, end, step)
+	if cachedEnd < end {
+		tail, partial, err := w.queryRange(ctx, name, query, cachedEnd+step, end, step)
+		if err != nil {
+			return nil, err
+		}
+		series = mergeSeries(series, tail, (cachedEnd+step-start)/step, (end-start)/step+1)
+		// The missing points of a partial response would be served from the cache until they expire.
+		if partial {
+			return series, nil
+		}
+	}
+
+	// The most recent points may still change, e.g. statsd hasn't flushed yet, so they are not cached.
+	freshEnd := time.Now().Add(-w.configFrom(ctx).RenderCache.Freshness).Unix() / step * step
+	if freshEnd > end {
+		freshEnd = end
+	}
+	w.renderCache.Set(key, start, freshEnd, step, series)
+
+	return series, nil
+}
+
+// mergeSeries copies the values of tail to series from offset, series missing on either side are filled with NaN.
+func mergeSeries(series, tail []*renderSeries, offset, count int64) []*renderSeries {
+	index := make(map[string]*renderSeries, len(series))
+	for _, s := range series {
+		index[s.Name] = s
+	}
+	for _, t := range tail {
+		s, ok := index[t.Name]
+		if !ok {
+			s = &renderSeries{
+				Name:   t.Name,
+				Values: makeNanArr(count),
 			}
+			index[t.Name] = s
+			series = append(series, s)
+		}
+		copy(s.Values[offset:], t.Values)
+	}
+	return series
+}
 
-			defer func() { _ = resp.Response().Body.Close() }()
+// queryRange queries the series of query from VictoriaMetrics in the [start, end] range, and reports whether they are partial.
+func (w *Wrapper) queryRange(ctx context.Context, name, query string, start, end, step int64) ([]*renderSeries, bool, error) {
+	window := fmt.Sprintf("%ds", step)
 
-			// We restrict particularly large responses to queries that can use MateQL.
-			body, err := ioutil.ReadAll(io.LimitReader(resp.Response().Body, w.config.PrometheusMaxBody))
-			if err != nil {
-				logger.Errorf("read response failed %s", err)
-				return
+	// In graphite, we do the downscaling in step window size
+	// This is different in VictoriaMetrics, so we need to specify the window size for the calculation with max_lookback.
+	// https://github.com/VictoriaMetrics/VictoriaMetrics/issues/549#issuecomment-653643283
+	params := req.Param{
+		"query":        query,
+		"start":        start,
+		"end":          end,
+		"step":         window,
+		"max_lookback": window,
+	}
+
+	// The span covers the wait of the limiter and the decoding of the series, besides the request to VictoriaMetrics.
+	ctx, span := tracer().Start(ctx, "query_range", trace.WithAttributes(
+		attribute.String("metricsql.query", query),
+		attribute.Int64("metricsql.step", step),
+	))
+	defer span.End()
+
+	release, err := w.limiter.Acquire(ctx)
+	if err != nil {
+		recordError(span, err)
+		return nil, false, err
+	}
+	defer release()
+
+	count := (end-start)/step + 1
+	series := make([]*renderSeries, 0)
+	index := make(map[string]*renderSeries)
+	partial, err := w.get(ctx, "/api/v1/query_range", params, func(reader io.Reader) (bool, error) {
+		decoder := decoderPool.Get().(*prometheus.MatrixDecoder)
+		defer decoderPool.Put(decoder)
+		// We restrict particularly large responses to queries that can use MateQL.
+		body := &countingReader{reader: reader}
+		defer func() { observeResponseSize("query_range", body.n) }()
+		decoder.Reset(body)
+
+		// The series are decoded one at a time, and the points are written directly to the aligned values.
+		err := decoder.Decode(func(m map[string]string, pairs []prometheus.MatrixPair) error {
+			// Sometimes the VictoriaMetrics adjustment logic return empty values that we can just ignore.
+			if len(pairs) == 0 {
+				return nil
 			}
 
-			data := new(prometheus.MatrixResponse)
-			err = json.Unmarshal(body, data)
-			if err != nil {
-				logger.Errorf("unmarshal %s failed %s", string(body), err)
-				return
+			target := prometheus.ConvertPrometheusMetric(name, m)
+			if target == "" {
+				log.Errorf("convert name:%s metric:%s to target failed", name, m)
+				return nil
 			}
 
-			for _, m := range data.Data.Result {
-				// Sometimes the VictoriaMetrics adjustment logic return empty values that we can just ignore.
-				if len(m.Values) == 0 {
-					continue
+			// The Prometheus response data is not continuous, we populate all intervals with Nan values.
+			// The series of a partial response may be responded by another replica too, the missing points are filled by it.
+			s, ok := index[target]
+			if !ok {
+				s = &renderSeries{
+					Name:   target,
+					Values: makeNanArr(count),
 				}
-
-				target := prometheus.ConvertPrometheusMetric(name, m.Metric)
-				if target == "" {
-					logger.Errorf("convert name:%s metric:%s to target failed", name, m.Metric)
+				index[target] = s
+				series = append(series, s)
+			}
+			for _, pair := range pairs {
+				offset := int64(pair.Timestamp) - start
+				if offset < 0 || offset%step != 0 || offset/step >= count || !math.IsNaN(s.Values[offset/step]) {
 					continue
 				}
+				s.Values[offset/step] = pair.Value
+			}
+			return nil
+		})
+		return decoder.IsPartial(), err
+	})
+	if err != nil {
+		recordError(span, err)
+	}
+	span.SetAttributes(
+		attribute.Int("graphite.series", len(series)),
+		attribute.Bool("victoriametrics.partial", partial),
+	)
+	return series, partial, err
+}
 
-				start := m.Values[0].Timestamp
-				end := m.Values[len(m.Values)-1].Timestamp
-				count := (end-start)/step + 1
-
-				// The Prometheus response data is not continuous, we populate all intervals with Nan values.
-				values := make([]float64, int(count))
-				var i, j int
-				for ; i < len(values); i++ {
-					values[i] = math.NaN()
-				searchValue:
-					for ; j < len(m.Values); j++ {
-						if start+float64(i)*step != m.Values[j].Timestamp {
-							break searchValue
-						}
-						values[i] = m.Values[j].Value
-					}
-				}
+// isRejected reports whether err is caused by the load shedding of the limiter.
+func isRejected(err error) bool {
+	return errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout)
+}
 
-				// Align the start and end points of the metric with the time of the request.
-				// Otherwise the division calculation in carbonapi will fail.
-				metricStart, metricEnd, metricStep := int64(start), int64(end), int64(step)
-				requestStart, requestEnd := request.StartTime, request.StopTime
-				if metricStart < requestStart {
-					startStep := int64(math.Ceil(float64(requestStart-metricStart) / float64(metricStep)))
-					metricStart = metricStart + startStep*metricStep
-					values = values[startStep:]
-				} else {
-					startStep := (metricStart - requestStart) / metricStep
-					metricStart = metricStart - startStep*metricStep
-					values = append(makeNanArr(startStep), values...)
-				}
-				if metricEnd > requestEnd {
-					stopStep := int64(math.Ceil(float64(metricEnd-requestEnd) / float64(metricStep)))
-					metricEnd = metricEnd - stopStep*metricStep
-					values = values[:int64(len(values))-stopStep]
-				} else {
-					stopStep := (requestEnd-requestStart)/metricStep + 1 - int64(len(values))
-					metricEnd = metricEnd + stopStep*metricStep
-					values = append(values, makeNanArr(stopStep)...)
-				}
+func isQueryError(err error) bool {
+	var qe queryError
+	return errors.As(err, &qe)
+}
 
-				// ConsolidationFunc is the consolidation strategy chosen by carbonapi to avoid exceeding MaxDataPoints in response to data.
-				// It can be modified by the function consolidateBy. https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.consolidateBy
-				// But now the query step is dynamic and response points must not exceed MaxDataPoints, so this configuration or function becomes unnecessary.
-				consolidationFunc := "avg"
-
-				metric := protov3.FetchResponse{
-					Name:              target,
-					PathExpression:    request.PathExpression,
-					RequestStartTime:  requestStart,
-					RequestStopTime:   requestEnd,
-					ConsolidationFunc: consolidationFunc,
-					StartTime:         metricStart,
-					StopTime:          metricEnd,
-					StepTime:          metricStep,
-					Values:            values,
-				}
+// queryError is an error caused by the query itself rather than the backend, such as matching too many series.
+type queryError struct {
+	error
+}
 
-				locker.Lock()
-				multiResponse.Metrics = append(multiResponse.Metrics, metric)
-				locker.Unlock()
-			}
-		}(request)
+func (e queryError) Unwrap() error {
+	return e.error
+}
+
+// deadlineError returns an error when the deadline of ctx has passed.
+func deadlineError(ctx context.Context) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil
 	}
+	return fmt.Errorf("request aborted %w", ctx.Err())
+}
 
-	wg.Wait()
-	return multiResponse, nil
+func errorStatus(err error) int {
+	if isRejected(err) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	if errors.As(err, &queryError{}) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
 }
 
 func makeNanArr(count int64) []float64 {
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func assertValues(t *testing.T, expected, actual []float64) {
+	t.Helper()
+	require.Equal(t, len(expected), len(actual), "values %v", actual)
+	for i := range expected {
+		if math.IsNaN(expected[i]) {
+			assert.True(t, math.IsNaN(actual[i]), "values[%d] = %v", i, actual[i])
+		} else {
+			assert.Equal(t, expected[i], actual[i], "values[%d]", i)
+		}
+	}
+}
+
+func TestWrapper_queryRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/query_range", r.URL.Path)
+		assert.Equal(t, "100", r.URL.Query().Get("start"))
+		assert.Equal(t, "140", r.URL.Query().Get("end"))
+		assert.Equal(t, "10s", r.URL.Query().Get("step"))
+		assert.Equal(t, "10s", r.URL.Query().Get("max_lookback"))
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"__a_g1__":"b"},"values":[[100,"1"],[120,"3"],[150,"5"]]},
+			{"metric":{"__a_g1__":"c"},"values":[]},
+			{"metric":{"__name__":"x","__a_g1__":"d"},"values":[[100,"1"]]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:     server.URL,
+		PrometheusMaxBody: 1024 * 1024,
+	})
+	series, partial, err := wrapper.queryRange(context.Background(), "a", "query", 100, 140, 10)
+	require.NoError(t, err)
+	assert.False(t, partial)
+	require.Len(t, series, 1)
+	assert.Equal(t, "a.b", series[0].Name)
+	assertValues(t, []float64{1, math.NaN(), 3, math.NaN(), math.NaN()}, series[0].Values)
+}
+
+func Test_mergeSeries(t *testing.T) {
+	nan := math.NaN()
+	series := []*renderSeries{
+		{Name: "a.b", Values: []float64{1, 2, nan, nan}},
+		{Name: "a.c", Values: []float64{1, 2, nan, nan}},
+	}
+	tail := []*renderSeries{
+		{Name: "a.b", Values: []float64{3, 4}},
+		{Name: "a.d", Values: []float64{3, 4}},
+	}
+	series = mergeSeries(series, tail, 2, 4)
+	require.Len(t, series, 3)
+	assert.Equal(t, "a.b", series[0].Name)
+	assertValues(t, []float64{1, 2, 3, 4}, series[0].Values)
+	assert.Equal(t, "a.c", series[1].Name)
+	assertValues(t, []float64{1, 2, nan, nan}, series[1].Values)
+	assert.Equal(t, "a.d", series[2].Name)
+	assertValues(t, []float64{nan, nan, 3, 4}, series[2].Values)
+}
+
+func TestWrapper_Find(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		assert.Equal(t, "/api/v1/label/__a_g2__/values", r.URL.Path)
+		assert.Equal(t, `{__name__="a",__a_g1__="b"}`, r.URL.Query().Get("match[]"))
+		_, _ = w.Write([]byte(`{"status":"success","data":["c","d"]}`))
+	}))
+	defer server.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:     server.URL,
+		PrometheusMaxBody: 1024 * 1024,
+		FindCache: FindCacheConfig{
+			Size:       10,
+			TTL:        time.Minute,
+			TimeBucket: time.Hour,
+		},
+	})
+
+	// Concurrent identical lookups share one request.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := wrapper.Find(context.Background(), &protov3.MultiGlobRequest{
+				Metrics:   []string{"a.b.*"},
+				StartTime: 3600,
+				StopTime:  7200,
+			})
+			assert.NoError(t, err)
+			require.Len(t, response.Metrics, 1)
+			assert.Equal(t, []protov3.GlobMatch{{Path: "a.b.c"}, {Path: "a.b.d"}}, response.Metrics[0].Matches)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// The same time bucket is served from the cache.
+	response, err := wrapper.Find(context.Background(), &protov3.MultiGlobRequest{
+		Metrics:   []string{"a.b.*"},
+		StartTime: 3700,
+		StopTime:  7300,
+	})
+	require.NoError(t, err)
+	require.Len(t, response.Metrics, 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestWrapper_findMatches_shared(t *testing.T) {
+	var requests int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			started <- struct{}{}
+			<-release
+		}
+		if r.URL.Query().Get("match[]") == `{__name__="bad",__bad_g1__="x"}` {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"422","error":"cannot parse"}`))
+			return
+		}
+		if r.URL.Query().Get("match[]") == `{__name__="partial",__partial_g1__="x"}` {
+			_, _ = w.Write([]byte(`{"status":"success","isPartial":true,"data":["c"]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":["c","d"]}`))
+	}))
+	defer server.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:     server.URL,
+		PrometheusMaxBody: 1024 * 1024,
+		FindCache:         FindCacheConfig{Size: 10, TTL: time.Minute, TimeBucket: time.Hour},
+		Timeout:           TimeoutConfig{Default: time.Minute},
+	})
+
+	// The follower gets the matches even though the request starting the lookup is canceled.
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, _, err := wrapper.findMatches(leaderCtx, "a.b.*", 3600, 7200)
+		leaderErr <- err
+	}()
+	<-started
+	followerMatches := make(chan []protov3.GlobMatch, 1)
+	go func() {
+		matches, _, err := wrapper.findMatches(context.Background(), "a.b.*", 3600, 7200)
+		assert.NoError(t, err)
+		followerMatches <- matches
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-leaderErr, context.Canceled)
+	close(release)
+	assert.Equal(t, []protov3.GlobMatch{{Path: "a.b.c"}, {Path: "a.b.d"}}, <-followerMatches)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// The error responses aren't cached.
+	for i := 0; i < 2; i++ {
+		_, _, err := wrapper.findMatches(context.Background(), "bad.x.*", 3600, 7200)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// Neither are the partial responses.
+	for i := 0; i < 2; i++ {
+		matches, _, err := wrapper.findMatches(context.Background(), "partial.x.*", 3600, 7200)
+		assert.NoError(t, err)
+		assert.Equal(t, []protov3.GlobMatch{{Path: "partial.x.c"}}, matches)
+	}
+	assert.Equal(t, int32(5), atomic.LoadInt32(&requests))
+}
+
+func TestWrapper_configFrom(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, `sum_over_time({__name__="a",__a_g1__="b",__a_g2__=""}[10s])`, r.URL.Query().Get("query"))
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer server.Close()
+
+	pinned := &Config{
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		StatsdFlushInterval: 10,
+		DefaultRollupFunc:   "sum_over_time",
+	}
+	wrapper := newWrapper(&Config{
+		PrometheusURL:       "http://reloaded",
+		PrometheusMaxBody:   1024 * 1024,
+		StatsdFlushInterval: 10,
+		DefaultRollupFunc:   "avg_over_time",
+	})
+	ctx := withConfig(context.Background(), pinned)
+	assert.Same(t, pinned, wrapper.configFrom(ctx))
+	assert.Equal(t, "http://reloaded", wrapper.configFrom(context.Background()).PrometheusURL)
+
+	// The request is served by the pinned config even though the current one differs.
+	_, err := wrapper.Render(ctx, &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{PathExpression: "a.b", StartTime: 1593561600, StopTime: 1593565200}},
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// The metrics are exposed on /metrics in Prometheus format.
+var (
+	findCacheRequests = metrics.NewCounter(`matecarbon_find_cache_requests_total`)
+	findCacheHits     = metrics.NewCounter(`matecarbon_find_cache_hits_total`)
+	// The lookups which shared the result of a concurrent identical lookup.
+	findCacheShared = metrics.NewCounter(`matecarbon_find_cache_shared_total`)
+
+	limiterRejectedQueueFull = metrics.NewCounter(`matecarbon_limiter_rejected_total{reason="queue_full"}`)
+	limiterRejectedTimeout   = metrics.NewCounter(`matecarbon_limiter_rejected_total{reason="queue_timeout"}`)
+
+	findTargetsTotal   = metrics.NewCounter(`matecarbon_find_targets_total`)
+	findMatchesTotal   = metrics.NewCounter(`matecarbon_find_matches_total`)
+	renderTargetsTotal = metrics.NewCounter(`matecarbon_render_targets_total`)
+	renderSeriesTotal  = metrics.NewCounter(`matecarbon_render_series_total`)
+	renderPointsTotal  = metrics.NewCounter(`matecarbon_render_points_total`)
+
+	// The lookups of the find targets by strategy, see FindConfig.
+	findLabelValuesLookups = metrics.NewCounter(`matecarbon_find_lookups_total{strategy="label_values"}`)
+	findSeriesLookups      = metrics.NewCounter(`matecarbon_find_lookups_total{strategy="series"}`)
+	// The series lookups which matched more than series_limit series.
+	findTruncated = metrics.NewCounter(`matecarbon_find_truncated_total`)
+
+	findLongPaths   = metrics.NewCounter(`matecarbon_long_paths_rejected_total{handler="find"}`)
+	renderLongPaths = metrics.NewCounter(`matecarbon_long_paths_rejected_total{handler="render"}`)
+	// The find requests of *, which would list the full amount of metrics.
+	rootQueriesBlocked = metrics.NewCounter(`matecarbon_root_queries_blocked_total`)
+
+	hedgedRequests   = metrics.NewCounter(`matecarbon_hedged_requests_total`)
+	replicaEjections = metrics.NewCounter(`matecarbon_replica_ejections_total`)
+	// The partial responses which are merged with the results of another replica.
+	partialResponses = metrics.NewCounter(`matecarbon_partial_responses_merged_total`)
+
+	// The find and render targets logged to the slow query log.
+	slowQueries = metrics.NewCounter(`matecarbon_slow_queries_total`)
+
+	// The union queries of the render batches, and the targets merged into them.
+	batchedQueries = metrics.NewCounter(`matecarbon_render_batch_queries_total`)
+	batchedTargets = metrics.NewCounter(`matecarbon_render_batch_targets_total`)
+)
+
+// observeRequest records the latency of a find or render request by the http status it maps to.
+func observeRequest(handler string, startTime time.Time, err error) {
+	status := 200
+	if err != nil {
+		status = errorStatus(err)
+	}
+	metrics.GetOrCreateHistogram(fmt.Sprintf(`matecarbon_request_duration_seconds{handler=%q,status="%d"}`, handler, status)).UpdateDuration(startTime)
+}
+
+// observeResponseSize records the body size of a VictoriaMetrics api response.
+func observeResponseSize(api string, size int64) {
+	metrics.GetOrCreateHistogram(fmt.Sprintf(`matecarbon_victoriametrics_response_size_bytes{api=%q}`, api)).Update(float64(size))
+}
+
+// countError counts the failed targets by the kind of the error.
+func countError(kind string) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`matecarbon_errors_total{kind=%q}`, kind)).Inc()
+}
+
+// errorKind classifies the errors of the VictoriaMetrics requests.
+func errorKind(err error) string {
+	switch {
+	case isRejected(err):
+		return "rejected"
+	case isQueryError(err):
+		return "query"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	default:
+		return "backend"
+	}
+}
+
+// countingReader counts the bytes read from a streaming response.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/metrics"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_errorKind(t *testing.T) {
+	assert.Equal(t, "rejected", errorKind(fmt.Errorf("acquire %w", errQueueFull)))
+	assert.Equal(t, "query", errorKind(queryError{errors.New("too many series")}))
+	assert.Equal(t, "canceled", errorKind(fmt.Errorf("get %w", context.DeadlineExceeded)))
+	assert.Equal(t, "backend", errorKind(errors.New("connection refused")))
+}
+
+func Test_countingReader(t *testing.T) {
+	reader := &countingReader{reader: strings.NewReader("hello")}
+	body, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, int64(5), reader.n)
+}
+
+func TestWrapper_Render_metrics(t *testing.T) {
+	wrapper, stop := newGraphiteTestWrapper(t)
+	defer stop()
+
+	points := renderPointsTotal.Get()
+	_, err := wrapper.Render(context.Background(), &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{PathExpression: "a.*", StartTime: 1593561600, StopTime: 1593561620},
+			{PathExpression: strings.Repeat("a", 8193), StartTime: 1593561600, StopTime: 1593561620},
+		},
+	})
+	require.NoError(t, err)
+	// Two series of three points.
+	assert.Equal(t, points+6, renderPointsTotal.Get())
+
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf, false)
+	assert.Contains(t, buf.String(), `matecarbon_request_duration_seconds_count{handler="render",status="200"}`)
+	assert.Contains(t, buf.String(), `matecarbon_victoriametrics_response_size_bytes_count{api="query_range"}`)
+	assert.Contains(t, buf.String(), `matecarbon_long_paths_rejected_total{handler="render"} `)
+}
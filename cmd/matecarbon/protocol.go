@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+
+	protov2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/zhihu/promate/graphite"
+)
+
+// The protocols spoken on /render/ and /metrics/find/, so the older carbonzipper and graphite-web cluster nodes can query matecarbon too.
+const (
+	// The request is a protobuf body, the default of carbonapi.
+	protocolV3 = "carbonapi_v3_pb"
+	// The request is in the query string, as carbonzipper sends.
+	protocolV2 = "carbonapi_v2_pb"
+	// The request is in the query string, as graphite-web CLUSTER_SERVERS send.
+	protocolPickle = "pickle"
+)
+
+var protocolFormats = map[string]string{
+	"carbonapi_v3_pb": protocolV3,
+	"carbonapi_v2_pb": protocolV2,
+	"protobuf":        protocolV2,
+	"protobuf3":       protocolV2,
+	"pickle":          protocolPickle,
+}
+
+var protocolContentTypes = map[string]string{
+	"application/x-carbonapi-v3-pb": protocolV3,
+	"application/x-carbonapi-v2-pb": protocolV2,
+	"application/pickle":            protocolPickle,
+}
+
+// negotiateProtocol chooses the protocol by the format parameter, then the Content-Type header, and falls back to carbonapi_v3_pb.
+func negotiateProtocol(r *http.Request) (string, error) {
+	// FormValue doesn't read the protobuf body, which is only parsed for form content types.
+	if format := r.FormValue("format"); format != "" {
+		protocol, ok := protocolFormats[format]
+		if !ok {
+			return "", fmt.Errorf("unsupported format %s", format)
+		}
+		return protocol, nil
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil {
+			if protocol, ok := protocolContentTypes[mediaType]; ok {
+				return protocol, nil
+			}
+		}
+	}
+	return protocolV3, nil
+}
+
+// renderHandler serves /render/ in all protocols, they share the same Wrapper.Render.
+func renderHandler(wrapper *Wrapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		protocol, err := negotiateProtocol(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var multiRequest *protov3.MultiFetchRequest
+		if protocol == protocolV3 {
+			multiRequest = &protov3.MultiFetchRequest{}
+			err = unmarshalBody(r, multiRequest)
+		} else {
+			multiRequest, err = parseRenderRequest(r)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		multiResponse, err := wrapper.Render(ctx, multiRequest)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		switch protocol {
+		case protocolV2:
+			writeProtobuf(w, convertFetchResponseV2(sortFetchResponses(multiRequest, multiResponse)))
+		case protocolPickle:
+			writeRenderPickle(w, sortFetchResponses(multiRequest, multiResponse))
+		default:
+			writeProtobuf(w, multiResponse)
+		}
+	}
+}
+
+// findHandler serves /metrics/find/ in all protocols, they share the same Wrapper.Find.
+func findHandler(wrapper *Wrapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		protocol, err := negotiateProtocol(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var multiRequest *protov3.MultiGlobRequest
+		if protocol == protocolV3 {
+			multiRequest = &protov3.MultiGlobRequest{}
+			err = unmarshalBody(r, multiRequest)
+		} else {
+			multiRequest, err = parseFindRequest(r)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		multiResponse, err := wrapper.Find(ctx, multiRequest)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		switch protocol {
+		case protocolV2:
+			writeProtobuf(w, &protov2.GlobResponse{
+				Name:    multiRequest.Metrics[0],
+				Matches: convertGlobMatchesV2(sortGlobMatches(multiResponse)),
+			})
+		case protocolPickle:
+			writeFindPickle(w, sortGlobMatches(multiResponse))
+		default:
+			writeProtobuf(w, multiResponse)
+		}
+	}
+}
+
+type protobufMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+func unmarshalBody(r *http.Request, message protobufMessage) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return message.Unmarshal(body)
+}
+
+func writeProtobuf(w http.ResponseWriter, message protobufMessage) {
+	blob, err := message.Marshal()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(blob)
+}
+
+// convertFetchResponseV2 converts the series to carbonapi_v2_pb, which marks the missing points with IsAbsent instead of NaN.
+// As in go-carbon, the stop time is exclusive.
+func convertFetchResponseV2(metrics []protov3.FetchResponse) *protov2.MultiFetchResponse {
+	multiResponse := &protov2.MultiFetchResponse{
+		Metrics: make([]protov2.FetchResponse, 0, len(metrics)),
+	}
+	for _, metric := range metrics {
+		values := make([]float64, len(metric.Values))
+		isAbsent := make([]bool, len(metric.Values))
+		for i, value := range metric.Values {
+			if math.IsNaN(value) {
+				isAbsent[i] = true
+			} else {
+				values[i] = value
+			}
+		}
+		multiResponse.Metrics = append(multiResponse.Metrics, protov2.FetchResponse{
+			Name:      metric.Name,
+			StartTime: int32(metric.StartTime),
+			StopTime:  int32(metric.StopTime + metric.StepTime),
+			StepTime:  int32(metric.StepTime),
+			Values:    values,
+			IsAbsent:  isAbsent,
+		})
+	}
+	return multiResponse
+}
+
+func convertGlobMatchesV2(matches []protov3.GlobMatch) []protov2.GlobMatch {
+	matchesV2 := make([]protov2.GlobMatch, 0, len(matches))
+	for _, match := range matches {
+		matchesV2 = append(matchesV2, protov2.GlobMatch{
+			Path:   match.Path,
+			IsLeaf: match.IsLeaf,
+		})
+	}
+	return matchesV2
+}
+
+// writeFindPickle writes the nodes with the keys of both graphite-web 1.x and 0.9.x.
+func writeFindPickle(w http.ResponseWriter, matches []protov3.GlobMatch) {
+	nodes := make([]map[string]interface{}, 0, len(matches))
+	for _, match := range matches {
+		nodes = append(nodes, map[string]interface{}{
+			"path":        match.Path,
+			"is_leaf":     match.IsLeaf,
+			"metric_path": match.Path,
+			"isLeaf":      match.IsLeaf,
+		})
+	}
+
+	blob, err := graphite.MarshalPickle(nodes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pickle")
+	_, _ = w.Write(blob)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	protov2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		want        string
+		wantErr     bool
+	}{
+		{name: "default", url: "/render/", want: protocolV3},
+		{name: "v2 format", url: "/render/?format=protobuf", want: protocolV2},
+		{name: "pickle format", url: "/render/?format=pickle", want: protocolPickle},
+		{name: "v3 content type", url: "/render/", contentType: "application/x-carbonapi-v3-pb", want: protocolV3},
+		{name: "v2 content type", url: "/render/", contentType: "application/x-carbonapi-v2-pb", want: protocolV2},
+		{name: "format first", url: "/render/?format=carbonapi_v3_pb", contentType: "application/pickle", want: protocolV3},
+		{name: "unknown format", url: "/render/?format=png", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			got, err := negotiateProtocol(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRenderHandler(t *testing.T) {
+	wrapper, stop := newGraphiteTestWrapper(t)
+	defer stop()
+
+	// carbonapi_v3_pb
+	body, err := (&protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{{
+		Name:           "a.b",
+		PathExpression: "a.b",
+		StartTime:      1593561600,
+		StopTime:       1593561620,
+	}}}).Marshal()
+	require.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	renderHandler(wrapper)(recorder, httptest.NewRequest("GET", "/render/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	responseV3 := &protov3.MultiFetchResponse{}
+	require.NoError(t, responseV3.Unmarshal(recorder.Body.Bytes()))
+	assert.Len(t, responseV3.Metrics, 2)
+
+	// carbonapi_v2_pb
+	recorder = httptest.NewRecorder()
+	renderHandler(wrapper)(recorder, httptest.NewRequest("GET", "/render/?format=protobuf&target=a.*&from=1593561600&until=1593561620", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	responseV2 := &protov2.MultiFetchResponse{}
+	require.NoError(t, responseV2.Unmarshal(recorder.Body.Bytes()))
+	require.Len(t, responseV2.Metrics, 2)
+	assert.Equal(t, protov2.FetchResponse{
+		Name:      "a.b",
+		StartTime: 1593561600,
+		StopTime:  1593561630,
+		StepTime:  10,
+		Values:    []float64{1, 0, 2.5},
+		IsAbsent:  []bool{false, true, false},
+	}, responseV2.Metrics[0])
+
+	// pickle
+	recorder = httptest.NewRecorder()
+	renderHandler(wrapper)(recorder, httptest.NewRequest("GET", "/render/?format=pickle&target=a.b&from=1593561600&until=1593561620", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/pickle", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "pathExpression")
+}
+
+func TestFindHandler(t *testing.T) {
+	wrapper, stop := newGraphiteTestWrapper(t)
+	defer stop()
+
+	recorder := httptest.NewRecorder()
+	findHandler(wrapper)(recorder, httptest.NewRequest("GET", "/metrics/find/?format=protobuf&query=a.*", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	response := &protov2.GlobResponse{}
+	require.NoError(t, response.Unmarshal(recorder.Body.Bytes()))
+	assert.Equal(t, protov2.GlobResponse{
+		Name:    "a.*",
+		Matches: []protov2.GlobMatch{{Path: "a.b"}, {Path: "a.c"}},
+	}, *response)
+
+	recorder = httptest.NewRecorder()
+	findHandler(wrapper)(recorder, httptest.NewRequest("GET", "/metrics/find/?format=pickle&query=a.*", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "metric_path")
+
+	recorder = httptest.NewRecorder()
+	findHandler(wrapper)(recorder, httptest.NewRequest("GET", "/metrics/find/", bytes.NewReader([]byte("invalid"))))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reload loads the config file and swaps it in, the current config is kept when the file is invalid.
+// The config is swapped as a whole, readers never see a partially loaded one.
+// The listen address, the limiter, the cache sizes, the log outputs and the tracing are only applied at startup.
+func (w *Wrapper) Reload(configPath string) error {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	old := w.Config()
+	if config.Listen != old.Listen ||
+		!reflect.DeepEqual(config.Limiter, old.Limiter) ||
+		config.RenderCache.MaxSize != old.RenderCache.MaxSize ||
+		config.FindCache.Size != old.FindCache.Size ||
+		config.FindCache.TTL != old.FindCache.TTL ||
+		!reflect.DeepEqual(config.ResolutionDiscovery, old.ResolutionDiscovery) ||
+		config.Log.Format != old.Log.Format ||
+		config.Log.SlowQuery.Path != old.Log.SlowQuery.Path ||
+		config.Tracing != old.Tracing {
+		log.Warnf("listen, limiter, cache sizes, resolution_discovery, log outputs and tracing changes take effect after restart")
+	}
+
+	w.config.Store(config)
+
+	// The cached results belong to the old backend.
+	if config.PrometheusURL != old.PrometheusURL {
+		if w.renderCache != nil {
+			w.renderCache.Purge()
+		}
+		if w.findCache != nil {
+			w.findCache.Purge()
+		}
+		if w.resolutionCache != nil {
+			w.resolutionCache.Purge()
+		}
+	}
+	return nil
+}
+
+// watchConfig reloads the config file on SIGHUP, and when it's modified if interval is positive.
+func watchConfig(wrapper *Wrapper, configPath string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	modTime := configModTime(configPath)
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			current := configModTime(configPath)
+			if current.Equal(modTime) {
+				continue
+			}
+			modTime = current
+		}
+
+		if err := wrapper.Reload(configPath); err != nil {
+			log.Errorf("reload config %s failed, keep the current config %s", configPath, err)
+			continue
+		}
+		log.Infof("reloaded config %s", configPath)
+	}
+}
+
+func configModTime(configPath string) time.Time {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapper_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matecarbon")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	configPath := filepath.Join(dir, "matecarbon.yaml")
+
+	write := func(body string) {
+		require.NoError(t, ioutil.WriteFile(configPath, []byte(body), 0644))
+	}
+
+	write("statsd_flush_interval: 10\nprometheus_url: http://a\nfind_cache:\n  size: 10\n  ttl: 1m\nrollups:\n  - match_suffix: \\.count\n    rollup_func: sum_over_time\n")
+	config, err := LoadConfig(configPath)
+	require.NoError(t, err)
+	wrapper := newWrapper(config)
+	wrapper.findCache.Set("a.*@0-0", nil)
+
+	// The invalid regexp keeps the current config.
+	write("statsd_flush_interval: 10\nprometheus_url: http://b\nrollups:\n  - match_suffix: (\n    rollup_func: sum_over_time\n")
+	assert.Error(t, wrapper.Reload(configPath))
+	assert.Equal(t, "http://a", wrapper.Config().PrometheusURL)
+	_, ok := wrapper.findCache.Get("a.*@0-0")
+	assert.True(t, ok)
+
+	// The fallback resolution is required.
+	write("prometheus_url: http://b\n")
+	assert.Error(t, wrapper.Reload(configPath))
+
+	write("statsd_flush_interval: 10\nprometheus_url: http://b\nrollups:\n  - match_suffix: \\.max\n    rollup_func: max_over_time\n")
+	require.NoError(t, wrapper.Reload(configPath))
+	assert.Equal(t, "http://b", wrapper.Config().PrometheusURL)
+	assert.Equal(t, "max_over_time", wrapper.Config().Rollups[0].RollupFunc)
+	// The backend changed, so the cached matches are dropped.
+	_, ok = wrapper.findCache.Get("a.*@0-0")
+	assert.False(t, ok)
+}
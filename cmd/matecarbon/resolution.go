@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/imroc/req"
+	"github.com/zhihu/promate/prometheus"
+)
+
+// ResolutionRule sets the interval between the samples of the matching paths, the first matching rule is used.
+type ResolutionRule struct {
+	// A graphite glob matching the full path, such as servers.*.cpu.*.
+	Pattern string `yaml:"pattern"`
+	// A regular expression matching the full path, it's used when the pattern is empty.
+	Regexp     string        `yaml:"regexp"`
+	Resolution time.Duration `yaml:"resolution"`
+
+	re *regexp.Regexp
+}
+
+// ResolutionDiscoveryConfig discovers the resolution of the targets not matching any rule with scrape_interval of MetricsQL.
+type ResolutionDiscoveryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// The lookbehind window of scrape_interval, 1h by default.
+	Window time.Duration `yaml:"window"`
+	// How long the discovered resolutions are cached, 10m by default.
+	TTL time.Duration `yaml:"ttl"`
+	// The maximum number of cached resolutions, 10000 by default.
+	Size int `yaml:"size"`
+}
+
+func compileResolutionRules(rules []*ResolutionRule) error {
+	for i, rule := range rules {
+		var err error
+		rule.re, err = compilePathRegexp(rule.Pattern, rule.Regexp)
+		if err != nil {
+			return fmt.Errorf("resolution rule %d: %w", i, err)
+		}
+		if rule.Resolution < time.Second {
+			return fmt.Errorf("resolution rule %d: resolution must be at least 1s", i)
+		}
+	}
+	return nil
+}
+
+// resolutionOf returns the interval between the samples of the target in seconds.
+// The rules are matched first, then the resolution is discovered if enabled, and the statsd flush interval at last.
+func (w *Wrapper) resolutionOf(ctx context.Context, path, selector string) float64 {
+	config := w.configFrom(ctx)
+	for _, rule := range config.Resolutions {
+		if rule.re.MatchString(path) {
+			return rule.Resolution.Seconds()
+		}
+	}
+
+	if w.resolutionCache != nil {
+		key := selector + "@" + w.backendURL(ctx)
+		resolution, ok := w.resolutionCache.Get(key)
+		if !ok {
+			// As findMatches, the panels of a dashboard share the discovery.
+			results := w.resolutionGroup.DoChan(key, func() (interface{}, error) {
+				ctx, cancel := sharedDeadline(ctx, config.Timeout)
+				defer cancel()
+				resolution, err := w.discoverResolution(ctx, selector)
+				if err != nil {
+					loggerFrom(ctx).Warnf("discover resolution of %s failed %s", selector, err)
+				}
+				// The failed and empty discoveries are cached too, so the targets without samples aren't discovered by each render.
+				w.resolutionCache.Set(key, resolution)
+				return resolution, nil
+			})
+			select {
+			case result := <-results:
+				resolution = result.Val.(float64)
+			case <-ctx.Done():
+			}
+		}
+		if resolution > 0 {
+			return resolution
+		}
+	}
+
+	return config.StatsdFlushInterval
+}
+
+// discoverResolution queries the largest scrape interval of the series in the window, it's 0 when there is no series.
+func (w *Wrapper) discoverResolution(ctx context.Context, selector string) (float64, error) {
+	window := w.configFrom(ctx).ResolutionDiscovery.Window
+	if window <= 0 {
+		window = time.Hour
+	}
+	params := req.Param{
+		"query": fmt.Sprintf(`max(scrape_interval(%s[%ds]))`, selector, int(window.Seconds())),
+	}
+
+	release, err := w.limiter.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	var resolution float64
+	_, err = w.get(ctx, "/api/v1/query", params, func(body io.Reader) (bool, error) {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return false, fmt.Errorf("read response failed %w", err)
+		}
+		observeResponseSize("query", int64(len(data)))
+
+		resp := new(prometheus.VectorResponse)
+		err = json.Unmarshal(data, resp)
+		if err != nil {
+			return false, fmt.Errorf("unmarshal %s failed %w", string(data), err)
+		}
+		if len(resp.Data.Result) > 0 && !math.IsNaN(resp.Data.Result[0].Value.Value) {
+			resolution = math.Max(resolution, resp.Data.Result[0].Value.Value)
+		}
+		return resp.IsPartial, nil
+	})
+	if err != nil || resolution == 0 {
+		return 0, err
+	}
+	// The samples are jittery, so the interval is rounded to seconds.
+	return math.Max(math.Round(resolution), 1), nil
+}
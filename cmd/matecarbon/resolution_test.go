@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapper_resolutionOf(t *testing.T) {
+	var queries int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/query", r.URL.Path)
+		atomic.AddInt32(&queries, 1)
+		switch r.URL.Query().Get("query") {
+		case `max(scrape_interval(a{__name_g1__="b"}[3600s]))`:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1593561600,"59.7"]}]}}`))
+		default:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{
+		StatsdFlushInterval: 10,
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		Resolutions: []*ResolutionRule{
+			{Pattern: "servers.*.cpu", Resolution: time.Second},
+		},
+		ResolutionDiscovery: ResolutionDiscoveryConfig{Enabled: true},
+	}
+	require.NoError(t, compileResolutionRules(config.Resolutions))
+	wrapper := newWrapper(config)
+
+	ctx := context.Background()
+	assert.Equal(t, float64(1), wrapper.resolutionOf(ctx, "servers.a.cpu", `servers{__name_g1__="a"}`))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&queries))
+
+	assert.Equal(t, float64(60), wrapper.resolutionOf(ctx, "a.b", `a{__name_g1__="b"}`))
+	assert.Equal(t, float64(60), wrapper.resolutionOf(ctx, "a.b", `a{__name_g1__="b"}`))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+
+	// Nothing discovered, fall back to the statsd flush interval.
+	assert.Equal(t, float64(10), wrapper.resolutionOf(ctx, "a.c", `a{__name_g1__="c"}`))
+	// The empty discovery is cached too.
+	assert.Equal(t, float64(10), wrapper.resolutionOf(ctx, "a.c", `a{__name_g1__="c"}`))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+}
+
+func Test_compileResolutionRules(t *testing.T) {
+	assert.NoError(t, compileResolutionRules([]*ResolutionRule{{Regexp: `a\..*`, Resolution: time.Minute}}))
+	assert.Error(t, compileResolutionRules([]*ResolutionRule{{Pattern: "a.*"}}))
+	assert.Error(t, compileResolutionRules([]*ResolutionRule{{Resolution: time.Minute}}))
+}
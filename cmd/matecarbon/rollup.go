@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zhihu/promate/prometheus"
+)
+
+// RollupRule is similar to the carbon storage schemas, the first rule matching the path expression of a target is used.
+// https://graphite.readthedocs.io/en/latest/config-carbon.html#storage-schemas-conf
+type RollupRule struct {
+	// A graphite glob matching the full path, such as stats.timers.*.*.count.
+	Pattern string `yaml:"pattern"`
+	// A regular expression matching the full path, it's used when the pattern is empty.
+	Regexp string `yaml:"regexp"`
+	// The type of the rule, the samples are rolled up by rollup_func by default.
+	// quantile rolls up the samples with quantile_over_time.
+	// histogram computes the quantile of the bucket series under the parent of the target, see Bucket.
+	// counter handles the resets of the monotonically increasing counters, see Counter.
+	Type string `yaml:"type"`
+	// The rollup function of the recent data. It's not used by quantile, and histogram rolls up the buckets with rate by default.
+	RollupFunc string `yaml:"rollup_func"`
+	// The values of a counter: per_second is the rate by default, per_step is the increase in each step,
+	// and cumulative is the counter with the resets removed, rolled up by rollup_func or last_over_time.
+	Counter string `yaml:"counter"`
+	// How the missing points are filled: nan by default, zero, previous carries the last value forward,
+	// and linear interpolates between the points around the gap. The points before the first value are left NaN by previous,
+	// and the points outside the values are left NaN by linear.
+	Fill string `yaml:"fill"`
+	// The φ of quantile and histogram in (0, 1], such as 0.99, it's required by them.
+	Quantile float64 `yaml:"quantile"`
+	// The path of the histogram buckets relative to the parent of the target, bucket by default.
+	// The last segment of a bucket is its upper bound, with _ as the decimal point, such as bucket.0_5 or bucket.inf.
+	// The target names the quantile series, e.g. a rule of api.*.latency.p99 computes api.x.latency.p99 from api.x.latency.bucket.*.
+	Bucket string `yaml:"bucket"`
+	// The minimum step of the queries, it's rounded up to a multiple of the resolution.
+	MinStep time.Duration `yaml:"min_step"`
+	// The minimum fraction of non-null samples in a step, the point is NaN below it. 0 accepts any sample.
+	XFilesFactor float64 `yaml:"x_files_factor"`
+	// The rollups of the older data, the retention with the largest age that the request start exceeds is used.
+	Retentions []*RollupRetention `yaml:"retentions"`
+
+	re *regexp.Regexp
+}
+
+type RollupRetention struct {
+	// The retention is used when the request starts more than age ago.
+	Age time.Duration `yaml:"age"`
+	// Overrides the rollup function of the rule when it's not empty.
+	RollupFunc string `yaml:"rollup_func"`
+	// Overrides the minimum step of the rule when it's not zero.
+	MinStep time.Duration `yaml:"min_step"`
+}
+
+// The types of the rollup rules.
+const (
+	rollupTypeFunc      = ""
+	rollupTypeQuantile  = "quantile"
+	rollupTypeHistogram = "histogram"
+	rollupTypeCounter   = "counter"
+)
+
+// The fill policies of the missing points.
+const (
+	fillNaN      = "nan"
+	fillZero     = "zero"
+	fillPrevious = "previous"
+	fillLinear   = "linear"
+)
+
+// The values of the counter rollups.
+const (
+	counterPerSecond  = "per_second"
+	counterPerStep    = "per_step"
+	counterCumulative = "cumulative"
+)
+
+// rollup is the strategy chosen for a render target.
+type rollup struct {
+	Type string
+	Func string
+	// In seconds.
+	MinStep      float64
+	XFilesFactor float64
+	Quantile     float64
+	Bucket       string
+	Counter      string
+	Fill         string
+}
+
+func compileRollupRules(rules []*RollupRule) error {
+	for i, rule := range rules {
+		var err error
+		rule.re, err = compilePathRegexp(rule.Pattern, rule.Regexp)
+		if err != nil {
+			return fmt.Errorf("rollup rule %d: %w", i, err)
+		}
+		switch rule.Type {
+		case rollupTypeFunc:
+			if rule.RollupFunc == "" {
+				return fmt.Errorf("rollup rule %d: rollup_func is required", i)
+			}
+		case rollupTypeQuantile, rollupTypeHistogram:
+			if rule.Quantile <= 0 || rule.Quantile > 1 {
+				return fmt.Errorf("rollup rule %d: quantile must be greater than 0 and at most 1", i)
+			}
+			// The buckets are summed up across the series, there are no samples of the target to count.
+			if rule.Type == rollupTypeHistogram && rule.XFilesFactor != 0 {
+				return fmt.Errorf("rollup rule %d: x_files_factor isn't supported by histogram", i)
+			}
+			if rule.Type == rollupTypeHistogram && rule.RollupFunc == "" {
+				rule.RollupFunc = "rate"
+			}
+			if rule.Type == rollupTypeHistogram && rule.Bucket == "" {
+				rule.Bucket = "bucket"
+			}
+		case rollupTypeCounter:
+			switch rule.Counter {
+			case "":
+				rule.Counter = counterPerSecond
+			case counterPerSecond, counterPerStep:
+			case counterCumulative:
+				if rule.RollupFunc == "" {
+					rule.RollupFunc = "last_over_time"
+				}
+			default:
+				return fmt.Errorf("rollup rule %d: counter %q is not one of per_second, per_step and cumulative", i, rule.Counter)
+			}
+		default:
+			return fmt.Errorf("rollup rule %d: type %q is not one of quantile, histogram and counter", i, rule.Type)
+		}
+		if rule.XFilesFactor < 0 || rule.XFilesFactor > 1 {
+			return fmt.Errorf("rollup rule %d: x_files_factor must be between 0 and 1", i)
+		}
+		if rule.MinStep < 0 {
+			return fmt.Errorf("rollup rule %d: min_step must not be negative", i)
+		}
+		switch rule.Fill {
+		case "", fillNaN, fillZero, fillPrevious, fillLinear:
+		default:
+			return fmt.Errorf("rollup rule %d: fill %q is not one of nan, zero, previous and linear", i, rule.Fill)
+		}
+		sort.Slice(rule.Retentions, func(i, j int) bool {
+			return rule.Retentions[i].Age < rule.Retentions[j].Age
+		})
+	}
+	return nil
+}
+
+// compilePathRegexp compiles a graphite glob or a regular expression to a regexp matching the full path.
+func compilePathRegexp(pattern, expr string) (*regexp.Regexp, error) {
+	switch {
+	case pattern != "" && expr != "":
+		return nil, errors.New("pattern and regexp are exclusive")
+	case pattern != "":
+		var err error
+		expr, err = prometheus.GlobToRegexPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+	case expr == "":
+		return nil, errors.New("pattern or regexp is required")
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// rollupOf returns the rollup of the path expression of a target which starts at start.
+// The rules are matched first, then the suffixes, and the default rollup function at last.
+func (c *Config) rollupOf(path string, start int64, now time.Time) rollup {
+	for _, rule := range c.RollupRules {
+		if !rule.re.MatchString(path) {
+			continue
+		}
+		result := rollup{
+			Type:         rule.Type,
+			Func:         rule.RollupFunc,
+			MinStep:      rule.MinStep.Seconds(),
+			XFilesFactor: rule.XFilesFactor,
+			Quantile:     rule.Quantile,
+			Bucket:       rule.Bucket,
+			Counter:      rule.Counter,
+			Fill:         rule.Fill,
+		}
+		age := now.Sub(time.Unix(start, 0))
+		for _, retention := range rule.Retentions {
+			if age < retention.Age {
+				break
+			}
+			if retention.RollupFunc != "" {
+				result.Func = retention.RollupFunc
+			}
+			if retention.MinStep > 0 {
+				result.MinStep = retention.MinStep.Seconds()
+			}
+		}
+		return result
+	}
+
+	// Similar to carbon's storage aggregation strategy, but in real time. https://graphite.readthedocs.io/en/latest/config-carbon.html#storage-aggregation-conf
+	// Here the aggregation strategy is chosen based on queries rather than stored metrics.
+	// In future the aggregation strategy needs to be determined based on the incoming consolidateBy function, not just the pre-configuration file.
+	// Which would require the carbonapi_v3_pb protocol to pass the aggregation strategy.
+	for _, r := range c.Rollups {
+		if r.MatchSuffixRe.MatchString(path) {
+			return rollup{Func: r.RollupFunc, XFilesFactor: r.XFilesFactor}
+		}
+	}
+	return rollup{Func: c.DefaultRollupFunc, XFilesFactor: c.DefaultXFilesFactor}
+}
+
+// Step returns the query step in seconds, a multiple of the resolution interval that is not less than the minimum step.
+func (r rollup) Step(timeRange, maxDataPoints, interval float64) float64 {
+	// Try to set step to a multiple of the resolution.
+	// Otherwise the returned result will be jittery.
+	step := math.Max(math.Ceil(timeRange/maxDataPoints/interval)*interval, interval)
+	if r.MinStep > step {
+		step = math.Ceil(r.MinStep/interval) * interval
+	}
+	return step
+}
+
+// Source returns the target whose series are queried for target, which is the buckets for a histogram.
+func (r rollup) Source(target string) string {
+	if r.Type != rollupTypeHistogram {
+		return target
+	}
+	i := strings.LastIndexByte(target, '.')
+	if i < 0 {
+		return target
+	}
+	return target[:i+1] + r.Bucket + ".*"
+}
+
+// Query returns the MetricsQL rolling up the selector of the source of target by step, looking back offset seconds when it's not 0.
+// Like the xFilesFactor of whisper, a point is dropped when the fraction of the samples expected by the resolution is too low.
+// The samples are counted by count_over_time in the same query, and queryRange fills the dropped points with NaN.
+func (r rollup) Query(target, selector string, step, interval float64, offset int64) string {
+	window := fmt.Sprintf(`%s[%ds]`, selector, int(step))
+	if offset != 0 {
+		window = fmt.Sprintf(`%s offset %ds`, window, offset)
+	}
+	if r.Type == rollupTypeHistogram {
+		return r.histogramQuery(target, window)
+	}
+
+	var query string
+	switch r.Type {
+	case rollupTypeQuantile:
+		query = fmt.Sprintf(`quantile_over_time(%g, %s)`, r.Quantile, window)
+	case rollupTypeCounter:
+		query = r.counterQuery(window)
+	default:
+		query = fmt.Sprintf(`%s(%s)`, r.Func, window)
+	}
+	if r.XFilesFactor > 0 {
+		minSamples := math.Ceil(r.XFilesFactor * step / interval)
+		query = fmt.Sprintf(`(%s) if (count_over_time(%s) >= %g)`, query, window, minSamples)
+	}
+	return query
+}
+
+// cacheable reports whether the points of the query are independent of the time range,
+// remove_resets accumulates the resets from the start of the range, so the points of another range can't be merged with them.
+func (r rollup) cacheable() bool {
+	return r.Type != rollupTypeCounter || r.Counter != counterCumulative
+}
+
+// counterQuery returns the MetricsQL of the counter values in window.
+// rate and increase of VictoriaMetrics correct the resets, and take the sample before the window into account,
+// so the increase between the steps isn't lost.
+func (r rollup) counterQuery(window string) string {
+	switch r.Counter {
+	case counterPerStep:
+		return fmt.Sprintf(`increase(%s)`, window)
+	case counterCumulative:
+		return fmt.Sprintf(`remove_resets(%s(%s))`, r.Func, window)
+	default:
+		return fmt.Sprintf(`rate(%s)`, window)
+	}
+}
+
+// histogramQuery returns the MetricsQL of the quantile of the buckets in window, named by target.
+// The upper bounds of the buckets are converted to the le label, and the buckets are summed by the parents of the target.
+func (r rollup) histogramQuery(target, window string) string {
+	name, _ := prometheus.ConvertGraphiteTarget(target, false)
+	nodes := strings.Split(target, ".")
+	parents := len(nodes) - 1
+	bound := prometheus.LabelName(name, parents+strings.Count(r.Bucket, ".")+1)
+
+	by := make([]string, 0, parents)
+	for i := 1; i < parents; i++ {
+		by = append(by, prometheus.LabelName(name, i))
+	}
+	by = append(by, "le")
+
+	buckets := fmt.Sprintf(`label_copy(%s(%s), %q, "le")`, r.Func, window, bound)
+	buckets = fmt.Sprintf(`label_transform(%s, "le", "_", ".")`, buckets)
+	buckets = fmt.Sprintf(`label_replace(%s, "le", "+Inf", "le", "(?i)\\+?inf")`, buckets)
+	query := fmt.Sprintf(`histogram_quantile(%g, sum(%s) by (%s))`, r.Quantile, buckets, strings.Join(by, ", "))
+	return fmt.Sprintf(`label_set(%s, %q, %q)`, query, prometheus.LabelName(name, parents), nodes[parents])
+}
+
+// fill returns the values with the missing points filled by the fill policy.
+// The values may be shared with the render cache, so they are copied rather than filled in place.
+func (r rollup) fill(values []float64) []float64 {
+	if r.Fill == "" || r.Fill == fillNaN {
+		return values
+	}
+
+	filled := make([]float64, len(values))
+	copy(filled, values)
+	switch r.Fill {
+	case fillZero:
+		for i, v := range filled {
+			if math.IsNaN(v) {
+				filled[i] = 0
+			}
+		}
+	case fillPrevious:
+		for i := 1; i < len(filled); i++ {
+			if math.IsNaN(filled[i]) {
+				filled[i] = filled[i-1]
+			}
+		}
+	case fillLinear:
+		last := -1
+		for i, v := range filled {
+			if math.IsNaN(v) {
+				continue
+			}
+			if last >= 0 && i-last > 1 {
+				slope := (v - filled[last]) / float64(i-last)
+				for j := last + 1; j < i; j++ {
+					filled[j] = filled[last] + slope*float64(j-last)
+				}
+			}
+			last = i
+		}
+	}
+	return filled
+}
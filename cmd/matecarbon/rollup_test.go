@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_rollupOf(t *testing.T) {
+	config := &Config{
+		RollupRules: []*RollupRule{
+			{
+				Pattern:      "stats.timers.*.count",
+				RollupFunc:   "last_over_time",
+				MinStep:      time.Minute,
+				XFilesFactor: 0.5,
+				Retentions: []*RollupRetention{
+					{Age: 30 * 24 * time.Hour, MinStep: time.Hour},
+					{Age: 7 * 24 * time.Hour, RollupFunc: "avg_over_time"},
+				},
+			},
+			{
+				Regexp:     `servers\.[^.]+\.cpu`,
+				RollupFunc: "max_over_time",
+			},
+		},
+		Rollups: []*RollupConfig{
+			{MatchSuffixRe: regexp.MustCompile(`\.count$`), RollupFunc: "sum_over_time"},
+			{MatchSuffixRe: regexp.MustCompile(`\.max$`), RollupFunc: "max_over_time", XFilesFactor: 0.3},
+		},
+		DefaultRollupFunc:   "avg_over_time",
+		DefaultXFilesFactor: 0.1,
+	}
+	require.NoError(t, compileRollupRules(config.RollupRules))
+
+	now := time.Unix(100*24*3600, 0)
+	ago := func(d time.Duration) int64 {
+		return now.Add(-d).Unix()
+	}
+
+	assert.Equal(t, rollup{Func: "last_over_time", MinStep: 60, XFilesFactor: 0.5},
+		config.rollupOf("stats.timers.api.count", ago(time.Hour), now))
+	assert.Equal(t, rollup{Func: "last_over_time", MinStep: 60, XFilesFactor: 0.5},
+		config.rollupOf("stats.timers.*.count", ago(time.Hour), now))
+	assert.Equal(t, rollup{Func: "avg_over_time", MinStep: 60, XFilesFactor: 0.5},
+		config.rollupOf("stats.timers.api.count", ago(8*24*time.Hour), now))
+	assert.Equal(t, rollup{Func: "avg_over_time", MinStep: 3600, XFilesFactor: 0.5},
+		config.rollupOf("stats.timers.api.count", ago(31*24*time.Hour), now))
+	assert.Equal(t, rollup{Func: "max_over_time"}, config.rollupOf("servers.a.cpu", ago(time.Hour), now))
+	// Full path matching, the deeper paths fall back to the suffixes.
+	assert.Equal(t, rollup{Func: "sum_over_time"}, config.rollupOf("stats.timers.api.get.count", ago(time.Hour), now))
+	assert.Equal(t, rollup{Func: "max_over_time", XFilesFactor: 0.3}, config.rollupOf("servers.a.max", ago(time.Hour), now))
+	assert.Equal(t, rollup{Func: "avg_over_time", XFilesFactor: 0.1}, config.rollupOf("servers.a.cpu.user", ago(time.Hour), now))
+}
+
+func Test_compileRollupRules(t *testing.T) {
+	assert.Error(t, compileRollupRules([]*RollupRule{{RollupFunc: "sum_over_time"}}))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.*", Regexp: "a", RollupFunc: "sum_over_time"}}))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.{b", RollupFunc: "sum_over_time"}}))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Regexp: "a(", RollupFunc: "sum_over_time"}}))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.*"}}))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.*", RollupFunc: "sum_over_time", XFilesFactor: 2}}))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.*", Type: "median"}}))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.*", Type: "quantile", Quantile: 99}}))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.*", Type: "quantile"}}))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.*", Type: "histogram"}}))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.*", Type: "histogram", Quantile: 0.99, XFilesFactor: 0.5}}))
+
+	rules := []*RollupRule{{Pattern: "a.*", Type: "histogram", Quantile: 0.99}}
+	require.NoError(t, compileRollupRules(rules))
+	assert.Equal(t, "rate", rules[0].RollupFunc)
+	assert.Equal(t, "bucket", rules[0].Bucket)
+}
+
+func Test_rollup_quantile(t *testing.T) {
+	r := rollup{Type: rollupTypeQuantile, Quantile: 0.99}
+	assert.Equal(t, "a.b", r.Source("a.b"))
+	assert.Equal(t, `quantile_over_time(0.99, a[60s])`, r.Query("a.b", "a", 60, 10, 0))
+	r.XFilesFactor = 0.5
+	assert.Equal(t, `(quantile_over_time(0.99, a[60s])) if (count_over_time(a[60s]) >= 3)`, r.Query("a.b", "a", 60, 10, 0))
+}
+
+func Test_rollup_counter(t *testing.T) {
+	rules := []*RollupRule{
+		{Pattern: "a.*", Type: "counter"},
+		{Pattern: "b.*", Type: "counter", Counter: "per_step", XFilesFactor: 0.5},
+		{Pattern: "c.*", Type: "counter", Counter: "cumulative"},
+	}
+	require.NoError(t, compileRollupRules(rules))
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.*", Type: "counter", Counter: "per_minute"}}))
+
+	config := &Config{RollupRules: rules}
+	now := time.Now()
+	query := func(target string) string {
+		return config.rollupOf(target, now.Unix(), now).Query(target, "s", 60, 10, 0)
+	}
+	assert.Equal(t, `rate(s[60s])`, query("a.x"))
+	assert.Equal(t, `(increase(s[60s])) if (count_over_time(s[60s]) >= 3)`, query("b.x"))
+	assert.Equal(t, `remove_resets(last_over_time(s[60s]))`, query("c.x"))
+
+	assert.True(t, config.rollupOf("a.x", now.Unix(), now).cacheable())
+	assert.False(t, config.rollupOf("c.x", now.Unix(), now).cacheable())
+}
+
+func Test_rollup_fill(t *testing.T) {
+	assert.Error(t, compileRollupRules([]*RollupRule{{Pattern: "a.*", RollupFunc: "sum_over_time", Fill: "mean"}}))
+
+	nan := math.NaN()
+	values := []float64{nan, 1, nan, nan, 4, nan}
+	assert.Equal(t, "[NaN 1 NaN NaN 4 NaN]", fmt.Sprint(rollup{}.fill(values)))
+	assert.Equal(t, "[NaN 1 NaN NaN 4 NaN]", fmt.Sprint(rollup{Fill: fillNaN}.fill(values)))
+	assert.Equal(t, []float64{0, 1, 0, 0, 4, 0}, rollup{Fill: fillZero}.fill(values))
+	assert.Equal(t, "[NaN 1 1 1 4 4]", fmt.Sprint(rollup{Fill: fillPrevious}.fill(values)))
+	assert.Equal(t, "[NaN 1 2 3 4 NaN]", fmt.Sprint(rollup{Fill: fillLinear}.fill(values)))
+	// The values shared with the render cache are kept.
+	assert.Equal(t, "[NaN 1 NaN NaN 4 NaN]", fmt.Sprint(values))
+}
+
+func Test_rollup_histogram(t *testing.T) {
+	r := rollup{Type: rollupTypeHistogram, Func: "rate", Quantile: 0.99, Bucket: "bucket"}
+	assert.Equal(t, "api.*.latency.bucket.*", r.Source("api.*.latency.p99"))
+	assert.Equal(t, `label_set(histogram_quantile(0.99, sum(label_replace(label_transform(label_copy(rate(s[60s] offset 3600s), "__api_g4__", "le"), "le", "_", "."), "le", "+Inf", "le", "(?i)\\+?inf")) by (__api_g1__, __api_g2__, le)), "__api_g3__", "p99")`,
+		r.Query("api.*.latency.p99", "s", 60, 10, 3600))
+
+	r.Bucket = "histogram.bucket"
+	assert.Equal(t, "api.*.latency.histogram.bucket.*", r.Source("api.*.latency.p99"))
+	assert.Contains(t, r.Query("api.*.latency.p99", "s", 60, 10, 0), `"__api_g5__", "le"`)
+}
+
+func Test_rollup(t *testing.T) {
+	r := rollup{Func: "sum_over_time", MinStep: 55}
+	assert.Equal(t, float64(10), rollup{Func: "sum_over_time"}.Step(3600, 1024, 10))
+	assert.Equal(t, float64(60), r.Step(3600, 1024, 10))
+	assert.Equal(t, float64(90), r.Step(86400, 1024, 10))
+
+	assert.Equal(t, `sum_over_time(a{__name_g1__="b"}[60s])`, r.Query("a.b", `a{__name_g1__="b"}`, 60, 10, 0))
+	r.XFilesFactor = 0.5
+	assert.Equal(t, `(sum_over_time(a[60s])) if (count_over_time(a[60s]) >= 3)`, r.Query("a", "a", 60, 10, 0))
+	// Any sample satisfies the factor when the step equals the resolution.
+	assert.Equal(t, `(sum_over_time(a[10s])) if (count_over_time(a[10s]) >= 1)`, r.Query("a", "a", 10, 10, 0))
+	assert.Equal(t, `(sum_over_time(a[60s] offset 86400s)) if (count_over_time(a[60s] offset 86400s) >= 3)`, r.Query("a", "a", 60, 10, 86400))
+}
+
+func TestWrapper_Render_histogram(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		assert.True(t, strings.HasPrefix(query, "label_set(histogram_quantile(0.5, "), query)
+		assert.Contains(t, query, `rate({__name__="api",__api_g2__="latency",__api_g3__="bucket",__api_g5__=""}[10s])`)
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"__api_g1__":"x","__api_g2__":"latency","__api_g3__":"p50"},"values":[[1593561600,"0.25"]]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	config := &Config{
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		StatsdFlushInterval: 10,
+		DefaultRollupFunc:   "avg_over_time",
+		RollupRules:         []*RollupRule{{Pattern: "api.*.latency.p50", Type: "histogram", Quantile: 0.5}},
+		RenderBatch:         RenderBatchConfig{MaxTargets: 10},
+	}
+	require.NoError(t, compileRollupRules(config.RollupRules))
+	wrapper := newWrapper(config)
+
+	multiResponse, err := wrapper.Render(context.Background(), &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{PathExpression: "api.*.latency.p50", StartTime: 1593561600, StopTime: 1593561600},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, multiResponse.Metrics, 1)
+	assert.Equal(t, "api.x.latency.p50", multiResponse.Metrics[0].Name)
+	assert.Equal(t, []float64{0.25}, multiResponse.Metrics[0].Values)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/zhihu/promate/graphite"
+)
+
+// timeShiftOf returns the time shift hinted by the timeShift filtering function of the request, it's negative when shifting to the past.
+// carbonapi sends the shifted time range of timeShift, with the hint we can query the original range with an offset instead,
+// so the query is aligned and cached in the same way as the unshifted one.
+func timeShiftOf(request protov3.FetchRequest) (time.Duration, error) {
+	for _, function := range request.FilterFunctions {
+		if function == nil || function.Name != "timeShift" {
+			continue
+		}
+		if len(function.Arguments) == 0 {
+			return 0, fmt.Errorf("timeShift without the shift")
+		}
+
+		shift := strings.Trim(strings.TrimSpace(function.Arguments[0]), `'"`)
+		// As in graphite, the shift without a sign is to the past.
+		if !strings.HasPrefix(shift, "+") && !strings.HasPrefix(shift, "-") {
+			shift = "-" + shift
+		}
+		offset, err := graphite.ParseOffset(shift)
+		if err != nil {
+			return 0, fmt.Errorf("timeShift %s: %w", function.Arguments[0], err)
+		}
+		if offset%time.Second != 0 {
+			return 0, fmt.Errorf("timeShift %s isn't in seconds", function.Arguments[0])
+		}
+		return offset, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeShiftOf(t *testing.T) {
+	shiftOf := func(functions ...*protov3.FilteringFunction) (time.Duration, error) {
+		return timeShiftOf(protov3.FetchRequest{FilterFunctions: functions})
+	}
+
+	shift, err := shiftOf()
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), shift)
+
+	shift, err = shiftOf(&protov3.FilteringFunction{Name: "timeShift", Arguments: []string{"7d"}})
+	require.NoError(t, err)
+	assert.Equal(t, -7*24*time.Hour, shift)
+
+	shift, err = shiftOf(
+		&protov3.FilteringFunction{Name: "alias", Arguments: []string{"x"}},
+		&protov3.FilteringFunction{Name: "timeShift", Arguments: []string{`"+1h"`}},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, shift)
+
+	shift, err = shiftOf(&protov3.FilteringFunction{Name: "timeShift", Arguments: []string{"'-1w'"}})
+	require.NoError(t, err)
+	assert.Equal(t, -7*24*time.Hour, shift)
+
+	_, err = shiftOf(&protov3.FilteringFunction{Name: "timeShift"})
+	assert.Error(t, err)
+	_, err = shiftOf(&protov3.FilteringFunction{Name: "timeShift", Arguments: []string{"1fortnight"}})
+	assert.Error(t, err)
+}
+
+func TestWrapper_Render_timeShift(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, `avg_over_time({__name__="a",__a_g1__="b",__a_g2__=""}[10s] offset 86400s)`, r.URL.Query().Get("query"))
+		assert.Equal(t, "1593561600", r.URL.Query().Get("start"))
+		assert.Equal(t, "1593561620", r.URL.Query().Get("end"))
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"__a_g1__":"b"},"values":[[1593561600,"1"],[1593561610,"2"],[1593561620,"3"]]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		StatsdFlushInterval: 10,
+		DefaultRollupFunc:   "avg_over_time",
+	})
+	// carbonapi sends the time range of the previous day.
+	multiResponse, err := wrapper.Render(context.Background(), &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{
+			PathExpression:  "a.b",
+			StartTime:       1593561600 - 86400,
+			StopTime:        1593561620 - 86400,
+			FilterFunctions: []*protov3.FilteringFunction{{Name: "timeShift", Arguments: []string{"1d"}}},
+		}},
+	})
+	require.NoError(t, err)
+	require.Len(t, multiResponse.Metrics, 1)
+
+	metric := multiResponse.Metrics[0]
+	// The series lies in the requested window, carbonapi shifts it back.
+	assert.Equal(t, int64(1593561600-86400), metric.RequestStartTime)
+	assert.Equal(t, int64(1593561620-86400), metric.RequestStopTime)
+	assert.Equal(t, int64(1593561600-86400), metric.StartTime)
+	assert.Equal(t, int64(1593561620-86400), metric.StopTime)
+	assert.Equal(t, []float64{1, 2, 3}, metric.Values)
+}
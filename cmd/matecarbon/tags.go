@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/imroc/req"
+	"github.com/zhihu/promate/prometheus"
+)
+
+// The graphite tags API backed by the labels of VictoriaMetrics, used by the Graphite datasource of Grafana.
+// The positional labels like __a_g1__ are shown as the g1 tag, see prometheus.ConvertPrometheusLabel.
+// https://graphite.readthedocs.io/en/latest/tags.html#exploring-tags
+
+const defaultTagsLimit = 100
+
+type tagResponse struct {
+	Tag string `json:"tag"`
+}
+
+// tagsHandler serves /tags?filter=..., which lists the tags matching the filter regexp.
+func tagsHandler(wrapper *Wrapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var filter *regexp.Regexp
+		if s := r.Form.Get("filter"); s != "" {
+			var err error
+			// Same as the re.match of graphite-web, the filter is only anchored at the start.
+			filter, err = regexp.Compile("^(?:" + s + ")")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		ctx := r.Context()
+		labels, _, err := wrapper.getValues(ctx, "/api/v1/labels", nil)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		tags := make([]tagResponse, 0)
+		for _, tag := range convertLabels(labels) {
+			if filter == nil || filter.MatchString(tag) {
+				tags = append(tags, tagResponse{Tag: tag})
+			}
+		}
+		writeJSON(w, tags)
+	}
+}
+
+// autoCompleteTagsHandler serves /tags/autoComplete/tags?tagPrefix=...&expr=...&limit=...
+// The tags of the series matching the expressions are returned, except the ones already in the expressions.
+func autoCompleteTagsHandler(wrapper *Wrapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, err := parseTagsLimit(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var params req.Param
+		exprs := r.Form["expr"]
+		used := make(map[string]bool, len(exprs))
+		if len(exprs) > 0 {
+			name, filters, err := prometheus.ConvertTagExpressions(exprs)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			params = req.Param{"match[]": filters.Build(name)}
+			for _, expr := range exprs {
+				used[expr[:strings.IndexAny(expr, "!=")]] = true
+			}
+		}
+
+		ctx := r.Context()
+		labels, _, err := wrapper.getValues(ctx, "/api/v1/labels", params)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		prefix := r.Form.Get("tagPrefix")
+		tags := make([]string, 0)
+		for _, tag := range convertLabels(labels) {
+			if len(tags) >= limit {
+				break
+			}
+			if !used[tag] && strings.HasPrefix(tag, prefix) {
+				tags = append(tags, tag)
+			}
+		}
+		writeJSON(w, tags)
+	}
+}
+
+// autoCompleteValuesHandler serves /tags/autoComplete/values?tag=...&valuePrefix=...&expr=...&limit=...
+// The expressions must contain name=<first segment> to complete the gN tags, which are positional labels of the name.
+func autoCompleteValuesHandler(wrapper *Wrapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, err := parseTagsLimit(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tag := r.Form.Get("tag")
+		if tag == "" {
+			http.Error(w, "missing parameter tag", http.StatusBadRequest)
+			return
+		}
+
+		var name string
+		var params req.Param
+		if exprs := r.Form["expr"]; len(exprs) > 0 {
+			var filters prometheus.LabelFilters
+			name, filters, err = prometheus.ConvertTagExpressions(exprs)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			params = req.Param{"match[]": filters.Build(name)}
+		} else if prometheus.IsPositionalTag(tag) {
+			http.Error(w, fmt.Sprintf("expr must contain name=<first segment> to complete the tag %s", tag), http.StatusBadRequest)
+			return
+		}
+		label := prometheus.ConvertTagLabel(name, tag)
+
+		ctx := r.Context()
+		values, _, err := wrapper.getValues(ctx, fmt.Sprintf("/api/v1/label/%s/values", label), params)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		sort.Strings(values)
+		prefix := r.Form.Get("valuePrefix")
+		matched := make([]string, 0)
+		for _, value := range values {
+			if len(matched) >= limit {
+				break
+			}
+			if strings.HasPrefix(value, prefix) {
+				matched = append(matched, value)
+			}
+		}
+		writeJSON(w, matched)
+	}
+}
+
+// convertLabels converts the labels to the sorted and deduplicated tags.
+func convertLabels(labels []string) []string {
+	seen := make(map[string]bool, len(labels))
+	tags := make([]string, 0, len(labels))
+	for _, label := range labels {
+		tag := prometheus.ConvertPrometheusLabel(label)
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func parseTagsLimit(r *http.Request) (int, error) {
+	s := r.Form.Get("limit")
+	if s == "" {
+		return defaultTagsLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid limit %s", s)
+	}
+	return limit, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
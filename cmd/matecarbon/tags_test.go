@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTagsTestWrapper(t *testing.T) (*Wrapper, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/labels":
+			if r.URL.Query().Get("match[]") != "" {
+				assert.Equal(t, `{__name__="a",__a_g1__="b"}`, r.URL.Query().Get("match[]"))
+				_, _ = w.Write([]byte(`{"status":"success","data":["__name__","__a_g1__","__a_g2__"]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"status":"success","data":["__name__","__a_g1__","__a_g2__","__b_g1__","env"]}`))
+		case "/api/v1/label/__a_g2__/values":
+			assert.Equal(t, `{__name__="a",__a_g1__="b"}`, r.URL.Query().Get("match[]"))
+			_, _ = w.Write([]byte(`{"status":"success","data":["y","x","z"]}`))
+		case "/api/v1/label/__name__/values":
+			_, _ = w.Write([]byte(`{"status":"success","data":["a","b"]}`))
+		case "/api/v1/query_range":
+			assert.Equal(t, `avg_over_time({__name__="a",__a_g1__=~"(?:b|c).*"}[10s])`, r.URL.Query().Get("query"))
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"__a_g1__":"b","__a_g2__":"x"},"values":[[1593561600,"1"]]}
+			]}}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	wrapper := newWrapper(&Config{
+		StatsdFlushInterval: 10,
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		DefaultRollupFunc:   "avg_over_time",
+	})
+	return wrapper, server.Close
+}
+
+func TestTagsHandler(t *testing.T) {
+	wrapper, stop := newTagsTestWrapper(t)
+	defer stop()
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		url        string
+		wantStatus int
+		want       string
+	}{
+		{
+			name:       "tags",
+			handler:    tagsHandler(wrapper),
+			url:        "/tags",
+			wantStatus: http.StatusOK,
+			want:       `[{"tag":"env"},{"tag":"g1"},{"tag":"g2"},{"tag":"name"}]`,
+		},
+		{
+			name:       "tags filter",
+			handler:    tagsHandler(wrapper),
+			url:        "/tags?filter=g",
+			wantStatus: http.StatusOK,
+			want:       `[{"tag":"g1"},{"tag":"g2"}]`,
+		},
+		{
+			name:       "autocomplete tags",
+			handler:    autoCompleteTagsHandler(wrapper),
+			url:        "/tags/autoComplete/tags?expr=name%3Da&expr=g1%3Db",
+			wantStatus: http.StatusOK,
+			want:       `["g2"]`,
+		},
+		{
+			name:       "autocomplete tags prefix and limit",
+			handler:    autoCompleteTagsHandler(wrapper),
+			url:        "/tags/autoComplete/tags?tagPrefix=g&limit=1",
+			wantStatus: http.StatusOK,
+			want:       `["g1"]`,
+		},
+		{
+			name:       "autocomplete values",
+			handler:    autoCompleteValuesHandler(wrapper),
+			url:        "/tags/autoComplete/values?tag=g2&expr=name%3Da&expr=g1%3Db&valuePrefix=&limit=2",
+			wantStatus: http.StatusOK,
+			want:       `["x","y"]`,
+		},
+		{
+			name:       "autocomplete names",
+			handler:    autoCompleteValuesHandler(wrapper),
+			url:        "/tags/autoComplete/values?tag=name",
+			wantStatus: http.StatusOK,
+			want:       `["a","b"]`,
+		},
+		{
+			name:       "autocomplete values without name",
+			handler:    autoCompleteValuesHandler(wrapper),
+			url:        "/tags/autoComplete/values?tag=g2",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			tt.handler(recorder, httptest.NewRequest("GET", tt.url, nil))
+			assert.Equal(t, tt.wantStatus, recorder.Code)
+			if tt.want != "" {
+				assert.Equal(t, tt.want, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestGraphiteRender_SeriesByTag(t *testing.T) {
+	wrapper, stop := newTagsTestWrapper(t)
+	defer stop()
+
+	recorder := httptest.NewRecorder()
+	graphiteRender(wrapper)(recorder, httptest.NewRequest("GET", "/render?format=raw&from=1593561600&until=1593561600&target="+
+		strings.ReplaceAll(`seriesByTag('name=a','g1=~b|c')`, "|", "%7C"), nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	graphiteRender(wrapper)(recorder, httptest.NewRequest("GET", "/render?format=raw&from=1593561600&until=1593561610&target="+
+		strings.ReplaceAll(`seriesByTag('name=a','g1=~b|c')`, "|", "%7C"), nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "a.b.x,1593561600,1593561620,10|1,None\n", recorder.Body.String())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/imroc/req"
+)
+
+// TimeoutConfig bounds the time of a find or render request.
+// The remaining time is passed to VictoriaMetrics as the timeout parameter, so it gives up the queries nobody waits for.
+type TimeoutConfig struct {
+	// The deadline of the requests without the header, 0 means no deadline.
+	Default time.Duration `yaml:"default"`
+	// The upper bound of the deadline taken from the header, 0 means unbounded.
+	Max time.Duration `yaml:"max"`
+	// The header carrying the timeout of the client in seconds or as a duration such as 30s,
+	// which carbonapi or the proxy in front of matecarbon sets from its own deadline.
+	Header string `yaml:"header"`
+}
+
+// withDeadline returns the context of the incoming request with the deadline of the timeout config.
+func withDeadline(ctx context.Context, r *http.Request, config TimeoutConfig) (context.Context, context.CancelFunc) {
+	timeout := config.Default
+	if config.Header != "" {
+		if value := r.Header.Get(config.Header); value != "" {
+			if t, err := parseTimeout(value); err == nil {
+				timeout = t
+			}
+		}
+	}
+	if config.Max > 0 && (timeout <= 0 || timeout > config.Max) {
+		timeout = config.Max
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// sharedDeadline returns a context of the work shared by the concurrent requests, such as a find lookup.
+// It keeps the values of ctx but isn't canceled with it, and is bounded by the max or the default timeout instead.
+func sharedDeadline(ctx context.Context, config TimeoutConfig) (context.Context, context.CancelFunc) {
+	ctx = context.WithoutCancel(ctx)
+	timeout := config.Max
+	if timeout <= 0 {
+		timeout = config.Default
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// requestContext is the middleware pinning the config, and setting the deadline of the timeout config and the client of the limiter on the request context.
+func requestContext(wrapper *Wrapper) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			config := wrapper.Config()
+			ctx, cancel := withDeadline(r.Context(), r, config.Timeout)
+			defer cancel()
+			ctx = withClient(ctx, r, config.Limiter.ClientHeader)
+			ctx = withConfig(ctx, config)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// parseTimeout parses a timeout in seconds, such as 30 or 2.5, or a duration such as 30s.
+func parseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds <= 0 {
+			return 0, fmt.Errorf("invalid timeout %s", value)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %s", value)
+	}
+	return timeout, nil
+}
+
+// withTimeoutParam returns a copy of params with the time remaining before the deadline of ctx as the timeout of VictoriaMetrics.
+func withTimeoutParam(ctx context.Context, params req.Param) (req.Param, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return params, nil
+	}
+	remaining := time.Until(deadline).Milliseconds()
+	if remaining <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+
+	copied := make(req.Param, len(params)+1)
+	for k, v := range params {
+		copied[k] = v
+	}
+	copied["timeout"] = fmt.Sprintf("%dms", remaining)
+	return copied, nil
+}
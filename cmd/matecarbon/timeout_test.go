@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/imroc/req"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithDeadline(t *testing.T) {
+	config := TimeoutConfig{Default: 30 * time.Second, Max: time.Minute, Header: "X-Timeout"}
+	remaining := func(header string, config TimeoutConfig) time.Duration {
+		r := httptest.NewRequest(http.MethodGet, "/render", nil)
+		if header != "" {
+			r.Header.Set("X-Timeout", header)
+		}
+		ctx, cancel := withDeadline(context.Background(), r, config)
+		defer cancel()
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return 0
+		}
+		return time.Until(deadline).Round(time.Second)
+	}
+
+	assert.Equal(t, 30*time.Second, remaining("", config))
+	assert.Equal(t, 10*time.Second, remaining("10", config))
+	assert.Equal(t, 5*time.Second, remaining("5s", config))
+	assert.Equal(t, time.Minute, remaining("1h", config))
+	assert.Equal(t, 30*time.Second, remaining("soon", config))
+	assert.Equal(t, 30*time.Second, remaining("-1", config))
+	assert.Equal(t, time.Duration(0), remaining("10", TimeoutConfig{}))
+	assert.Equal(t, time.Minute, remaining("", TimeoutConfig{Max: time.Minute}))
+}
+
+func TestRequestContext(t *testing.T) {
+	wrapper := newWrapper(&Config{
+		Timeout: TimeoutConfig{Header: "X-Timeout"},
+		Limiter: LimiterConfig{ClientHeader: "X-Grafana-User"},
+	})
+
+	var deadline time.Time
+	var client string
+	handler := requestContext(wrapper)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ = r.Context().Deadline()
+		client = clientFromContext(r.Context())
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/render", nil)
+	r.Header.Set("X-Timeout", "10")
+	r.Header.Set("X-Grafana-User", "admin")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Equal(t, 10*time.Second, time.Until(deadline).Round(time.Second))
+	assert.Equal(t, "admin", client)
+}
+
+func TestWithTimeoutParam(t *testing.T) {
+	params := req.Param{"query": "a"}
+	copied, err := withTimeoutParam(context.Background(), params)
+	require.NoError(t, err)
+	assert.Equal(t, params, copied)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	copied, err = withTimeoutParam(ctx, params)
+	require.NoError(t, err)
+	assert.Equal(t, "a", copied["query"])
+	assert.True(t, strings.HasSuffix(copied["timeout"].(string), "ms"))
+	assert.NotContains(t, params, "timeout")
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = withTimeoutParam(ctx, params)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestWrapper_Render_deadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NotEmpty(t, r.URL.Query().Get("timeout"))
+		if strings.Contains(r.URL.Query().Get("query"), "slow") {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer server.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		StatsdFlushInterval: 10,
+		DefaultRollupFunc:   "avg_over_time",
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	startTime := time.Now()
+	_, err := wrapper.Render(ctx, &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{PathExpression: "fast.a", StartTime: 1593561600, StopTime: 1593565200},
+			{PathExpression: "slow.a", StartTime: 1593561600, StopTime: 1593565200},
+		},
+	})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, errorStatus(err))
+	assert.Less(t, int64(time.Since(startTime)), int64(time.Second))
+}
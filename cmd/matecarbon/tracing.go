@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig exports the OpenTelemetry spans of the requests with OTLP over HTTP.
+// The trace context of carbonapi is continued, and propagated to VictoriaMetrics in the traceparent header.
+type TracingConfig struct {
+	// The OTLP/HTTP endpoint, such as http://otel-collector:4318. Tracing is disabled when it's empty.
+	Endpoint string `yaml:"endpoint"`
+	// The fraction of the traces sampled when carbonapi doesn't decide it, 1 by default.
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// The service.name of the spans, matecarbon by default.
+	ServiceName string `yaml:"service_name"`
+}
+
+const tracerName = "github.com/zhihu/promate/cmd/matecarbon"
+
+// tracer returns the tracer of the current global provider.
+// It isn't kept in a variable, which would be bound to the first provider set.
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// setupTracing sets the global tracer provider and propagator.
+// The returned provider is nil when tracing is disabled, otherwise it must be shut down on exit to flush the batched spans.
+func setupTracing(config TracingConfig) (*sdktrace.TracerProvider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config.Endpoint == "" {
+		return nil, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(config.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	ratio := config.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "matecarbon"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider, nil
+}
+
+// traceHandler starts a server span for each request, named by the method and the path.
+func traceHandler(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "matecarbon", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + r.URL.Path
+	}))
+}
+
+// recordError marks the span failed with err.
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	provider, err := setupTracing(TracingConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, provider)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"__a_g1__":"b"},"values":[[1593561600,"1"]]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	wrapper := newWrapper(&Config{
+		PrometheusURL:       server.URL,
+		PrometheusMaxBody:   1024 * 1024,
+		StatsdFlushInterval: 10,
+		DefaultRollupFunc:   "avg_over_time",
+	})
+
+	// The trace of carbonapi is continued by the server span.
+	const incoming = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	var traceID trace.TraceID
+	handler := traceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceID = trace.SpanContextFromContext(r.Context()).TraceID()
+		_, err := wrapper.Render(r.Context(), &protov3.MultiFetchRequest{
+			Metrics: []protov3.FetchRequest{
+				{PathExpression: "a.b", StartTime: 1593561600, StopTime: 1593565200},
+			},
+		})
+		assert.NoError(t, err)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/render/", nil)
+	r.Header.Set("traceparent", incoming)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", traceID.String())
+	assert.Contains(t, traceparent, traceID.String())
+
+	names := make(map[string]bool)
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, traceID, span.SpanContext().TraceID(), span.Name())
+		names[span.Name()] = true
+	}
+	assert.True(t, names["GET /render/"])
+	assert.True(t, names["render target"])
+	assert.True(t, names["query_range"])
+	assert.Len(t, names, 4, "the client span of query_range is missing")
+}
@@ -0,0 +1,137 @@
+// Package graphite implements the parts of the graphite-web protocol that are needed to serve its HTTP API.
+package graphite
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The opcodes of pickle protocol 2, which can be loaded by both python 2 and python 3.
+// https://github.com/python/cpython/blob/master/Lib/pickletools.py
+const (
+	opProto      = 0x80
+	opStop       = '.'
+	opNone       = 'N'
+	opNewTrue    = 0x88
+	opNewFalse   = 0x89
+	opBinInt     = 'J'
+	opLong1      = 0x8a
+	opBinFloat   = 'G'
+	opBinUnicode = 'X'
+	opEmptyList  = ']'
+	opEmptyDict  = '}'
+	opMark       = '('
+	opAppends    = 'e'
+	opSetItems   = 'u'
+)
+
+// MarshalPickle encodes v with pickle protocol 2.
+// Supported types are nil, bool, int, int64, float64, string, []float64, []string,
+// []interface{}, []map[string]interface{} and map[string]interface{}.
+// NaN values of []float64 are encoded as None, as graphite-web does for missing points.
+func MarshalPickle(v interface{}) ([]byte, error) {
+	buf := []byte{opProto, 2}
+	buf, err := appendPickle(buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, opStop), nil
+}
+
+func appendPickle(buf []byte, v interface{}) ([]byte, error) {
+	var err error
+	switch v := v.(type) {
+	case nil:
+		buf = append(buf, opNone)
+	case bool:
+		if v {
+			buf = append(buf, opNewTrue)
+		} else {
+			buf = append(buf, opNewFalse)
+		}
+	case int:
+		buf = appendPickleInt(buf, int64(v))
+	case int64:
+		buf = appendPickleInt(buf, v)
+	case float64:
+		buf = appendPickleFloat(buf, v)
+	case string:
+		buf = appendPickleString(buf, v)
+	case []float64:
+		buf = append(buf, opEmptyList, opMark)
+		for _, f := range v {
+			if math.IsNaN(f) {
+				buf = append(buf, opNone)
+			} else {
+				buf = appendPickleFloat(buf, f)
+			}
+		}
+		buf = append(buf, opAppends)
+	case []string:
+		buf = append(buf, opEmptyList, opMark)
+		for _, s := range v {
+			buf = appendPickleString(buf, s)
+		}
+		buf = append(buf, opAppends)
+	case []interface{}:
+		buf = append(buf, opEmptyList, opMark)
+		for _, item := range v {
+			if buf, err = appendPickle(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		buf = append(buf, opAppends)
+	case []map[string]interface{}:
+		buf = append(buf, opEmptyList, opMark)
+		for _, item := range v {
+			if buf, err = appendPickle(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		buf = append(buf, opAppends)
+	case map[string]interface{}:
+		// Sort the keys so that the output is stable.
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf = append(buf, opEmptyDict, opMark)
+		for _, key := range keys {
+			buf = appendPickleString(buf, key)
+			if buf, err = appendPickle(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		buf = append(buf, opSetItems)
+	default:
+		return nil, fmt.Errorf("unsupported pickle type %T", v)
+	}
+	return buf, nil
+}
+
+func appendPickleInt(buf []byte, i int64) []byte {
+	if i >= math.MinInt32 && i <= math.MaxInt32 {
+		buf = append(buf, opBinInt, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(buf[len(buf)-4:], uint32(int32(i)))
+		return buf
+	}
+	buf = append(buf, opLong1, 8, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(buf[len(buf)-8:], uint64(i))
+	return buf
+}
+
+func appendPickleFloat(buf []byte, f float64) []byte {
+	buf = append(buf, opBinFloat, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], math.Float64bits(f))
+	return buf
+}
+
+func appendPickleString(buf []byte, s string) []byte {
+	buf = append(buf, opBinUnicode, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(buf[len(buf)-4:], uint32(len(s)))
+	return append(buf, s...)
+}
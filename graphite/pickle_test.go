@@ -0,0 +1,67 @@
+package graphite
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalPickle(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "none",
+			v:    nil,
+			want: "\x80\x02N.",
+		},
+		{
+			name: "int",
+			v:    1,
+			want: "\x80\x02J\x01\x00\x00\x00.",
+		},
+		{
+			name: "long",
+			v:    int64(1) << 40,
+			want: "\x80\x02\x8a\x08\x00\x00\x00\x00\x00\x01\x00\x00.",
+		},
+		{
+			name: "float",
+			v:    1.5,
+			want: "\x80\x02G\x3f\xf8\x00\x00\x00\x00\x00\x00.",
+		},
+		{
+			name: "values",
+			v:    []float64{1, math.NaN()},
+			want: "\x80\x02](G\x3f\xf0\x00\x00\x00\x00\x00\x00Ne.",
+		},
+		{
+			name: "dict",
+			v: map[string]interface{}{
+				"isLeaf":      false,
+				"metric_path": "a.b",
+			},
+			want: "\x80\x02}(X\x06\x00\x00\x00isLeaf\x89X\x0b\x00\x00\x00metric_pathX\x03\x00\x00\x00a.bu.",
+		},
+		{
+			name:    "unsupported",
+			v:       struct{}{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MarshalPickle(tt.v)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package graphite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The units of relative time supported by graphite-web.
+// https://graphite.readthedocs.io/en/latest/render_api.html#from-until
+var timeUnits = []struct {
+	prefix   string
+	duration time.Duration
+}{
+	// Order matters, "mon" and "min" must be matched before "m".
+	{"mon", 30 * 24 * time.Hour},
+	{"min", time.Minute},
+	{"s", time.Second},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"y", 365 * 24 * time.Hour},
+}
+
+// ParseTime parses the from and until parameters of the graphite render API into a unix timestamp.
+// It supports now, unix timestamps, relative times like -1h or -7days and absolute times like 04:00_20200101 or 20200101.
+func ParseTime(s string, now time.Time) (int64, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "" || s == "now":
+		return now.Unix(), nil
+	case s[0] == '-' || s[0] == '+':
+		offset, err := ParseOffset(s)
+		if err != nil {
+			return 0, err
+		}
+		return now.Add(offset).Unix(), nil
+	}
+
+	// A timestamp has more digits than the YYYYMMDD date.
+	if len(s) > 8 {
+		if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return ts, nil
+		}
+	}
+	for _, layout := range []string{"15:04_20060102", "20060102", "15:04 20060102"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %q", s)
+}
+
+// ParseOffset parses a relative time like -1h, -5min or +7days.
+func ParseOffset(s string) (time.Duration, error) {
+	sign := time.Duration(1)
+	switch {
+	case strings.HasPrefix(s, "-"):
+		sign = -1
+		s = s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i <= 0 {
+		return 0, fmt.Errorf("invalid offset %q", s)
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	unit := s[i:]
+	for _, u := range timeUnits {
+		if strings.HasPrefix(unit, u.prefix) {
+			return sign * time.Duration(n) * u.duration, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid offset unit %q", unit)
+}
@@ -0,0 +1,42 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{s: "", want: now.Unix()},
+		{s: "now", want: now.Unix()},
+		{s: "-1h", want: now.Add(-time.Hour).Unix()},
+		{s: "-5min", want: now.Add(-5 * time.Minute).Unix()},
+		{s: "-7days", want: now.Add(-7 * 24 * time.Hour).Unix()},
+		{s: "-2months", want: now.Add(-60 * 24 * time.Hour).Unix()},
+		{s: "+30s", want: now.Add(30 * time.Second).Unix()},
+		{s: "1593561600", want: 1593561600},
+		{s: "20200701", want: time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC).Unix()},
+		{s: "04:00_20200701", want: time.Date(2020, 7, 1, 4, 0, 0, 0, time.UTC).Unix()},
+		{s: "-1", wantErr: true},
+		{s: "-1x", wantErr: true},
+		{s: "yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseTime(tt.s, now)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
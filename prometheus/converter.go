@@ -3,6 +3,7 @@ package prometheus
 import (
 	"bytes"
 	"fmt"
+	"regexp"
 	"strings"
 	"sync"
 
@@ -27,7 +28,13 @@ func (l LabelFilters) Build(name string) (selector string) {
 	builder.WriteByte('"')
 
 	for _, filter := range l {
-		if filter.IsRegexp {
+		if filter.IsRegexp && filter.IsNegative {
+			builder.WriteByte(',')
+			builder.WriteString(filter.Label)
+			builder.WriteString(`!~"`)
+			builder.WriteString(filter.Value)
+			builder.WriteByte('"')
+		} else if filter.IsRegexp {
 			builder.WriteByte(',')
 			builder.WriteString(filter.Label)
 			builder.WriteString(`=~"`)
@@ -124,6 +131,65 @@ func ConvertPrometheusMetric(name string, metric map[string]string) string {
 	return builder.String()
 }
 
+// LabelName returns the label of the i-th segment of the paths under name, the name is the first segment.
+func LabelName(name string, i int) string {
+	return labelName(name, i)
+}
+
 func labelName(name string, i int) string {
 	return fmt.Sprintf("__%s_g%d__", name, i)
 }
+
+// PathMatcher matches the paths converted by ConvertPrometheusMetric against the label filters of a selector,
+// so the series of a query merging several selectors can be told apart.
+type PathMatcher struct {
+	name    string
+	filters LabelFilters
+	res     []*regexp.Regexp
+}
+
+func NewPathMatcher(name string, filters LabelFilters) (*PathMatcher, error) {
+	m := &PathMatcher{
+		name:    name,
+		filters: filters,
+		res:     make([]*regexp.Regexp, len(filters)),
+	}
+	for i, filter := range filters {
+		if !filter.IsRegexp {
+			continue
+		}
+		// The regular expressions of the label filters are fully anchored in Prometheus.
+		re, err := regexp.Compile("^(?:" + filter.Value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.res[i] = re
+	}
+	return m, nil
+}
+
+func (m *PathMatcher) Match(path string) bool {
+	nodes := strings.Split(path, ".")
+	if nodes[0] != m.name {
+		return false
+	}
+
+	labels := make(map[string]string, len(nodes)-1)
+	for i := 1; i < len(nodes); i++ {
+		labels[labelName(m.name, i)] = nodes[i]
+	}
+	for i, filter := range m.filters {
+		// A missing label matches the empty value.
+		value := labels[filter.Label]
+		var matched bool
+		if filter.IsRegexp {
+			matched = m.res[i].MatchString(value)
+		} else {
+			matched = value == filter.Value
+		}
+		if matched == filter.IsNegative {
+			return false
+		}
+	}
+	return true
+}
@@ -214,11 +214,17 @@ func TestLabelFilters_Build(t *testing.T) {
 					Value:      "v3",
 					IsNegative: true,
 				},
+				{
+					Label:      "g4",
+					Value:      "v4",
+					IsRegexp:   true,
+					IsNegative: true,
+				},
 			},
 			args: args{
 				name: "name",
 			},
-			wantSelector: `{__name__="name",g1="v1",g2=~"v2",g3!="v3"}`,
+			wantSelector: `{__name__="name",g1="v1",g2=~"v2",g3!="v3",g4!~"v4"}`,
 		},
 	}
 	for _, tt := range tests {
@@ -257,3 +263,41 @@ func Test_labelName(t *testing.T) {
 		})
 	}
 }
+
+func TestPathMatcher_Match(t *testing.T) {
+	tests := []struct {
+		target string
+		path   string
+		want   bool
+	}{
+		{target: "a.b.c", path: "a.b.c", want: true},
+		{target: "a.b.c", path: "a.b.d", want: false},
+		{target: "a.b.c", path: "a.b.c.d", want: false},
+		{target: "a.b.c", path: "x.b.c", want: false},
+		{target: "a.*.c", path: "a.x.c", want: true},
+		{target: "a.*", path: "a.x.c", want: false},
+		{target: "a.b*.{c,d}", path: "a.bx.d", want: true},
+		{target: "a.b*.{c,d}", path: "a.xb.d", want: false},
+		{target: "a-b.c", path: "a_b.c", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target+" "+tt.path, func(t *testing.T) {
+			name, filters := ConvertGraphiteTarget(tt.target, true)
+			m, err := NewPathMatcher(name, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Match(tt.path); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	m, err := NewPathMatcher("a", LabelFilters{{Label: "__a_g1__", Value: "b.*", IsRegexp: true, IsNegative: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Match("a.bc") || !m.Match("a.cb") {
+		t.Errorf("negative regexp filter mismatched")
+	}
+}
@@ -0,0 +1,163 @@
+package prometheus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var decoderConfig = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// MatrixDecoder decodes a query_range response one series at a time.
+// Unlike MatrixResponse it never holds the whole body or the whole result in memory,
+// and the points are parsed without any per point allocation.
+type MatrixDecoder struct {
+	iter    *jsoniter.Iterator
+	metric  map[string]string
+	values  []MatrixPair
+	partial bool
+}
+
+func NewMatrixDecoder(reader io.Reader) *MatrixDecoder {
+	return &MatrixDecoder{
+		iter:   jsoniter.Parse(decoderConfig, reader, 64*1024),
+		metric: make(map[string]string),
+		values: make([]MatrixPair, 0, 1024),
+	}
+}
+
+// Reset makes the decoder read from reader, so that it can be reused with a sync.Pool.
+func (d *MatrixDecoder) Reset(reader io.Reader) {
+	d.iter.Reset(reader)
+	d.iter.Error = nil
+}
+
+// Decode calls fn for each series of the response.
+// The metric and values passed to fn are reused by the next series and must not be retained.
+func (d *MatrixDecoder) Decode(fn func(metric map[string]string, values []MatrixPair) error) error {
+	var status, errorType, errorMessage string
+	var fnErr error
+	d.partial = false
+
+	iter := d.iter
+	iter.ReadObjectCB(func(iter *jsoniter.Iterator, field string) bool {
+		switch field {
+		case "status":
+			status = iter.ReadString()
+		case "errorType":
+			errorType = iter.ReadString()
+		case "error":
+			errorMessage = iter.ReadString()
+		case "isPartial":
+			d.partial = iter.ReadBool()
+		case "data":
+			iter.ReadObjectCB(func(iter *jsoniter.Iterator, field string) bool {
+				if field != "result" {
+					iter.Skip()
+					return true
+				}
+				iter.ReadArrayCB(func(iter *jsoniter.Iterator) bool {
+					if !d.readSeries() {
+						return false
+					}
+					fnErr = fn(d.metric, d.values)
+					return fnErr == nil
+				})
+				return fnErr == nil
+			})
+		default:
+			iter.Skip()
+		}
+		return fnErr == nil && iter.Error == nil
+	})
+
+	if fnErr != nil {
+		return fnErr
+	}
+	if iter.Error != nil && !errors.Is(iter.Error, io.EOF) {
+		return iter.Error
+	}
+	if status == "error" {
+		return fmt.Errorf("%s: %s", errorType, errorMessage)
+	}
+	return nil
+}
+
+// IsPartial reports whether the last decoded response is partial, which VictoriaMetrics responds when some vmstorage nodes are unavailable.
+func (d *MatrixDecoder) IsPartial() bool {
+	return d.partial
+}
+
+func (d *MatrixDecoder) readSeries() bool {
+	for key := range d.metric {
+		delete(d.metric, key)
+	}
+	d.values = d.values[:0]
+
+	iter := d.iter
+	iter.ReadObjectCB(func(iter *jsoniter.Iterator, field string) bool {
+		switch field {
+		case "metric":
+			iter.ReadMapCB(func(iter *jsoniter.Iterator, label string) bool {
+				d.metric[label] = iter.ReadString()
+				return true
+			})
+		case "values":
+			iter.ReadArrayCB(func(iter *jsoniter.Iterator) bool {
+				pair, ok := d.readPair()
+				if ok {
+					d.values = append(d.values, pair)
+				}
+				return ok
+			})
+		default:
+			iter.Skip()
+		}
+		return iter.Error == nil
+	})
+	return iter.Error == nil
+}
+
+// readPair reads a `[1590249600,"1"]` point.
+func (d *MatrixDecoder) readPair() (pair MatrixPair, ok bool) {
+	iter := d.iter
+	if !iter.ReadArray() {
+		iter.ReportError("read pair", "expected timestamp")
+		return pair, false
+	}
+	pair.Timestamp = iter.ReadFloat64()
+	if !iter.ReadArray() {
+		iter.ReportError("read pair", "expected value")
+		return pair, false
+	}
+	value, err := parseValue(iter.ReadStringAsSlice())
+	if err != nil {
+		iter.ReportError("read pair", err.Error())
+		return pair, false
+	}
+	pair.Value = value
+	if iter.ReadArray() {
+		iter.ReportError("read pair", "length mismatch, expected 2")
+		return pair, false
+	}
+	return pair, iter.Error == nil
+}
+
+func parseValue(b []byte) (float64, error) {
+	// Short cut for the common values, which also avoids converting to string.
+	switch len(b) {
+	case 1:
+		if b[0] >= '0' && b[0] <= '9' {
+			return float64(b[0] - '0'), nil
+		}
+	case 3:
+		if b[0] == 'N' && b[1] == 'a' && b[2] == 'N' {
+			return math.NaN(), nil
+		}
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
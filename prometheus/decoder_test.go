@@ -0,0 +1,167 @@
+package prometheus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatrixDecoder_Decode(t *testing.T) {
+	body := `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"__a_g1__":"b","__a_g2__":"c"},"values":[[1590249600,"1"],[1590249610,"2.5"],[1590249620,"NaN"]]},
+		{"metric":{"__a_g1__":"d"},"values":[]},
+		{"values":[[1590249600,"-1e3"]],"metric":{"__a_g1__":"e"}}
+	]}}`
+
+	var metrics []string
+	var values [][]MatrixPair
+	decoder := NewMatrixDecoder(strings.NewReader(body))
+	err := decoder.Decode(func(metric map[string]string, pairs []MatrixPair) error {
+		metrics = append(metrics, ConvertPrometheusMetric("a", metric))
+		values = append(values, append([]MatrixPair(nil), pairs...))
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"a.b.c", "a.d", "a.e"}, metrics)
+	require.Len(t, values, 3)
+	require.Len(t, values[0], 3)
+	assert.Equal(t, MatrixPair{Timestamp: 1590249600, Value: 1}, values[0][0])
+	assert.Equal(t, MatrixPair{Timestamp: 1590249610, Value: 2.5}, values[0][1])
+	assert.True(t, math.IsNaN(values[0][2].Value))
+	assert.Len(t, values[1], 0)
+	assert.Equal(t, []MatrixPair{{Timestamp: 1590249600, Value: -1000}}, values[2])
+}
+
+func TestMatrixDecoder_DecodeError(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{
+			name: "error response",
+			body: `{"status":"error","errorType":"422","error":"too many points"}`,
+		},
+		{
+			name: "truncated",
+			body: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1590249600,"1"],[159`,
+		},
+		{
+			name: "length mismatch",
+			body: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1590249600,"1",1]]}]}}`,
+		},
+		{
+			name: "invalid value",
+			body: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1590249600,"x"]]}]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder := NewMatrixDecoder(strings.NewReader(tt.body))
+			err := decoder.Decode(func(metric map[string]string, values []MatrixPair) error { return nil })
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMatrixDecoder_Reset(t *testing.T) {
+	stop := errors.New("stop")
+	decoder := NewMatrixDecoder(strings.NewReader(`{"data":{"result":[{"metric":{"x":"y"},"values":[[1,"1"]]},{"values":[[2,"2"]]}]}}`))
+	err := decoder.Decode(func(metric map[string]string, values []MatrixPair) error { return stop })
+	assert.Equal(t, stop, err)
+
+	count := 0
+	decoder.Reset(strings.NewReader(`{"data":{"result":[{"values":[[3,"3"]]}]}}`))
+	err = decoder.Decode(func(metric map[string]string, values []MatrixPair) error {
+		count++
+		assert.Empty(t, metric)
+		assert.Equal(t, []MatrixPair{{Timestamp: 3, Value: 3}}, values)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestMatrixDecoder_IsPartial(t *testing.T) {
+	decoder := NewMatrixDecoder(strings.NewReader(`{"status":"success","isPartial":true,"data":{"result":[]}}`))
+	require.NoError(t, decoder.Decode(func(metric map[string]string, values []MatrixPair) error { return nil }))
+	assert.True(t, decoder.IsPartial())
+
+	decoder.Reset(strings.NewReader(`{"status":"success","data":{"result":[]}}`))
+	require.NoError(t, decoder.Decode(func(metric map[string]string, values []MatrixPair) error { return nil }))
+	assert.False(t, decoder.IsPartial())
+}
+
+func benchmarkMatrixBody(series, points int) []byte {
+	builder := bytes.NewBufferString(`{"status":"success","data":{"resultType":"matrix","result":[`)
+	for i := 0; i < series; i++ {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		fmt.Fprintf(builder, `{"metric":{"__a_g1__":"host%d","__a_g2__":"cpu"},"values":[`, i)
+		for j := 0; j < points; j++ {
+			if j > 0 {
+				builder.WriteByte(',')
+			}
+			fmt.Fprintf(builder, `[%d,"%g"]`, 1590249600+j*10, float64(j)*1.5)
+		}
+		builder.WriteString(`]}`)
+	}
+	builder.WriteString(`]}}`)
+	return builder.Bytes()
+}
+
+func BenchmarkMatrixResponse_Unmarshal(b *testing.B) {
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	body := benchmarkMatrixBody(100, 1024)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blob, err := ioutil.ReadAll(bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		data := new(MatrixResponse)
+		if err := json.Unmarshal(blob, data); err != nil {
+			b.Fatal(err)
+		}
+		for _, m := range data.Data.Result {
+			values := make([]float64, len(m.Values))
+			for j, pair := range m.Values {
+				values[j] = pair.Value
+			}
+		}
+	}
+}
+
+func BenchmarkMatrixDecoder_Decode(b *testing.B) {
+	body := benchmarkMatrixBody(100, 1024)
+	reader := bytes.NewReader(body)
+	decoder := NewMatrixDecoder(reader)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(body)
+		decoder.Reset(reader)
+		err := decoder.Decode(func(metric map[string]string, pairs []MatrixPair) error {
+			values := make([]float64, len(pairs))
+			for j, pair := range pairs {
+				values[j] = pair.Value
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -136,3 +136,9 @@ func globToRegexPattern(glob string) (string, bool, error) {
 
 	return pattern.buff.String(), regexed, nil
 }
+
+// GlobToRegexPattern converts a graphite glob to a regular expression pattern, which isn't anchored.
+func GlobToRegexPattern(glob string) (string, error) {
+	pattern, _, err := globToRegexPattern(glob)
+	return pattern, err
+}
@@ -7,8 +7,19 @@ import (
 )
 
 type ValuesResponse struct {
-	Status string   `json:"status"`
-	Data   []string `json:"data"`
+	Status    string   `json:"status"`
+	ErrorType string   `json:"errorType"`
+	Error     string   `json:"error"`
+	IsPartial bool     `json:"isPartial"`
+	Data      []string `json:"data"`
+}
+
+type SeriesResponse struct {
+	Status    string              `json:"status"`
+	ErrorType string              `json:"errorType"`
+	Error     string              `json:"error"`
+	IsPartial bool                `json:"isPartial"`
+	Data      []map[string]string `json:"data"`
 }
 
 type MatrixResponse struct {
@@ -26,6 +37,22 @@ type MatrixData struct {
 	Values []MatrixPair      `json:"values"`
 }
 
+type VectorResponse struct {
+	Status    string       `json:"status"`
+	IsPartial bool         `json:"isPartial"`
+	Data      VectorResult `json:"data"`
+}
+
+type VectorResult struct {
+	Result     []VectorData `json:"result"`
+	ResultType string       `json:"resultType"`
+}
+
+type VectorData struct {
+	Metric map[string]string `json:"metric"`
+	Value  MatrixPair        `json:"value"`
+}
+
 type MatrixPair struct {
 	Timestamp float64
 	Value     float64
@@ -0,0 +1,150 @@
+package prometheus
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zhihu/promate/mateql"
+)
+
+// The graphite tags are mapped to the labels written by mateinsert.
+// The name tag is the first segment of the path, which is __name__ in VictoriaMetrics,
+// and the gN tag is the Nth segment of the path, which is the positional __<name>_gN__ label.
+// https://graphite.readthedocs.io/en/latest/tags.html
+
+const seriesByTagPrefix = "seriesByTag("
+
+// IsSeriesByTag reports whether target is a seriesByTag('tag=value', ...) expression.
+func IsSeriesByTag(target string) bool {
+	return strings.HasPrefix(target, seriesByTagPrefix)
+}
+
+// ConvertSeriesByTag converts seriesByTag('name=a', 'g1=~b', ...) to the name and label filters of the selector.
+func ConvertSeriesByTag(target string) (string, LabelFilters, error) {
+	if !IsSeriesByTag(target) || !strings.HasSuffix(target, ")") {
+		return "", nil, fmt.Errorf("invalid seriesByTag %s", target)
+	}
+	args := target[len(seriesByTagPrefix) : len(target)-1]
+
+	exprs := make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		switch c := args[i]; c {
+		case ' ', ',':
+		case '\'', '"':
+			end := strings.IndexByte(args[i+1:], c)
+			if end < 0 {
+				return "", nil, fmt.Errorf("unclosed quote in seriesByTag %s", target)
+			}
+			exprs = append(exprs, args[i+1:i+1+end])
+			i += end + 1
+		default:
+			return "", nil, fmt.Errorf("unexpected %q in seriesByTag %s", c, target)
+		}
+	}
+	return ConvertTagExpressions(exprs)
+}
+
+// ConvertTagExpressions converts the tag expressions like name=a, g1!=b, g2=~c and g3!=~d to the name and label filters.
+// The name must be matched exactly, otherwise the positional labels are unknown.
+func ConvertTagExpressions(exprs []string) (string, LabelFilters, error) {
+	type tagExpr struct {
+		tag      string
+		operator string
+		value    string
+	}
+
+	var name string
+	parsed := make([]tagExpr, 0, len(exprs))
+	for _, expr := range exprs {
+		i := strings.IndexAny(expr, "!=")
+		if i <= 0 {
+			return "", nil, fmt.Errorf("invalid tag expression %s", expr)
+		}
+		tag, rest := expr[:i], expr[i:]
+
+		var operator string
+		for _, op := range []string{"!=~", "=~", "!=", "="} {
+			if strings.HasPrefix(rest, op) {
+				operator = op
+				break
+			}
+		}
+		if operator == "" {
+			return "", nil, fmt.Errorf("invalid tag expression %s", expr)
+		}
+		value := rest[len(operator):]
+
+		if tag == "name" && operator == "=" {
+			name = strings.ReplaceAll(value, "-", "_")
+			continue
+		}
+		parsed = append(parsed, tagExpr{tag: tag, operator: operator, value: value})
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("the tag expressions must contain name=<first segment>")
+	}
+
+	filters := make(LabelFilters, 0, len(parsed))
+	for _, expr := range parsed {
+		filter := mateql.LabelFilter{
+			Label:      ConvertTagLabel(name, expr.tag),
+			Value:      expr.value,
+			IsRegexp:   strings.HasSuffix(expr.operator, "~"),
+			IsNegative: strings.HasPrefix(expr.operator, "!"),
+		}
+		// The regular expressions of graphite are only anchored at the start, but the ones of VictoriaMetrics are fully anchored.
+		if filter.IsRegexp {
+			filter.Value = "(?:" + filter.Value + ").*"
+		}
+		filters = append(filters, filter)
+	}
+	return name, filters, nil
+}
+
+// ConvertTagLabel converts the tag name to the label name, e.g. name to __name__ and g1 to __a_g1__.
+// Other tags are passed through as is.
+func ConvertTagLabel(name, tag string) string {
+	if tag == "name" {
+		return "__name__"
+	}
+	if n, ok := positionalTag(tag); ok {
+		return labelName(name, n)
+	}
+	return tag
+}
+
+// ConvertPrometheusLabel converts the label name to the tag name, e.g. __name__ to name and __a_g1__ to g1.
+// Other labels are passed through as is.
+func ConvertPrometheusLabel(label string) string {
+	if label == "__name__" {
+		return "name"
+	}
+	if len(label) > 4 && strings.HasPrefix(label, "__") && strings.HasSuffix(label, "__") {
+		inner := label[2 : len(label)-2]
+		if i := strings.LastIndex(inner, "_g"); i >= 0 {
+			if _, ok := positionalTag(inner[i+1:]); ok {
+				return inner[i+1:]
+			}
+		}
+	}
+	return label
+}
+
+// IsPositionalTag reports whether tag is a gN tag, which can only be converted to a label with the name.
+func IsPositionalTag(tag string) bool {
+	_, ok := positionalTag(tag)
+	return ok
+}
+
+// positionalTag parses the N of the gN tag.
+func positionalTag(tag string) (int, bool) {
+	if len(tag) < 2 || tag[0] != 'g' {
+		return 0, false
+	}
+	n, err := strconv.Atoi(tag[1:])
+	if err != nil || n <= 0 || tag[1] == '+' {
+		return 0, false
+	}
+	return n, true
+}
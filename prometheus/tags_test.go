@@ -0,0 +1,78 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertSeriesByTag(t *testing.T) {
+	tests := []struct {
+		name         string
+		target       string
+		wantSelector string
+		wantErr      bool
+	}{
+		{
+			name:         "equal",
+			target:       `seriesByTag('name=a-b','g1=c')`,
+			wantSelector: `{__name__="a_b",__a_b_g1__="c"}`,
+		},
+		{
+			name:         "operators",
+			target:       `seriesByTag('g1!=c', "name=a", 'g2=~d', 'g3!=~e|f', 'env=prod')`,
+			wantSelector: `{__name__="a",__a_g1__!="c",__a_g2__=~"(?:d).*",__a_g3__!~"(?:e|f).*",env="prod"}`,
+		},
+		{
+			name:    "without name",
+			target:  `seriesByTag('g1=c')`,
+			wantErr: true,
+		},
+		{
+			name:    "regexp name",
+			target:  `seriesByTag('name=~a')`,
+			wantErr: true,
+		},
+		{
+			name:    "unclosed quote",
+			target:  `seriesByTag('name=a)`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid expression",
+			target:  `seriesByTag('name')`,
+			wantErr: true,
+		},
+		{
+			name:    "not seriesByTag",
+			target:  `a.b.c`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, filters, err := ConvertSeriesByTag(tt.target)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSelector, filters.Build(name))
+		})
+	}
+}
+
+func TestConvertPrometheusLabel(t *testing.T) {
+	assert.Equal(t, "name", ConvertPrometheusLabel("__name__"))
+	assert.Equal(t, "g1", ConvertPrometheusLabel("__a_g1__"))
+	assert.Equal(t, "g12", ConvertPrometheusLabel("__a_b_g12__"))
+	assert.Equal(t, "env", ConvertPrometheusLabel("env"))
+	assert.Equal(t, "__a_gx__", ConvertPrometheusLabel("__a_gx__"))
+}
+
+func TestConvertTagLabel(t *testing.T) {
+	assert.Equal(t, "__name__", ConvertTagLabel("a", "name"))
+	assert.Equal(t, "__a_g1__", ConvertTagLabel("a", "g1"))
+	assert.Equal(t, "env", ConvertTagLabel("a", "env"))
+	assert.Equal(t, "g0", ConvertTagLabel("a", "g0"))
+}